@@ -1,70 +1,187 @@
 package main
 
 import (
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"regexp"
+	"time"
 
+	"github.com/aeytom/silence-data/events"
 	"github.com/aeytom/silence-data/hass"
+	"github.com/aeytom/silence-data/logging"
+	"github.com/aeytom/silence-data/silence"
 	"github.com/go-yaml/yaml"
 )
 
 type DotEnv struct {
 	Silence struct {
-		Email    string `yaml:"email" json:"email,omitempty"`
-		Password string `yaml:"password" json:"password,omitempty"`
+		Email    logging.Personal `yaml:"email" json:"email,omitempty"`
+		Password logging.Secret   `yaml:"password" json:"password,omitempty"`
 	} `yaml:"silence" json:"silence,omitempty"`
 	Influx struct {
-		Org    string `yaml:"org,omitempty" json:"org,omitempty"`
-		Bucket string `yaml:"bucket,omitempty" json:"bucket,omitempty"`
-		Token  string `yaml:"token" json:"token,omitempty"`
-		Url    string `yaml:"url" json:"url,omitempty"`
+		Org    string         `yaml:"org,omitempty" json:"org,omitempty"`
+		Bucket string         `yaml:"bucket,omitempty" json:"bucket,omitempty"`
+		Token  logging.Secret `yaml:"token" json:"token,omitempty"`
+		Url    string         `yaml:"url" json:"url,omitempty"`
 	} `yaml:"influx" json:"influx,omitempty"`
 	HomeAssistant hass.Config `yaml:"home_assistant,omitempty" json:"home_assistant,omitempty"`
+	Http          struct {
+		Listen string `yaml:"listen,omitempty" json:"listen,omitempty"`
+	} `yaml:"http,omitempty" json:"http,omitempty"`
+	Log          logging.Config `yaml:"log,omitempty" json:"log,omitempty"`
+	PollInterval time.Duration  `yaml:"poll_interval,omitempty" json:"poll_interval,omitempty"`
+	StateDir     string         `yaml:"state_dir,omitempty" json:"state_dir,omitempty"`
+	Trips        struct {
+		SyncInterval time.Duration `yaml:"sync_interval,omitempty" json:"sync_interval,omitempty"`
+		PageSize     int32         `yaml:"page_size,omitempty" json:"page_size,omitempty"`
+	} `yaml:"trips,omitempty" json:"trips,omitempty"`
+	Events struct {
+		ConnectionTimeout time.Duration `yaml:"connection_timeout,omitempty" json:"connection_timeout,omitempty"`
+	} `yaml:"events,omitempty" json:"events,omitempty"`
 }
 
 // Command line args
 var (
 	Conf DotEnv
+
+	envPath     *string
+	configFlags map[string]*string
+
+	logger = slog.Default()
 )
 
 // ParseArgs parses command line flags
 func ParseArgs() {
 
-	envPath := getEnvArg("DOT_ENV", "dotEnv", ".env.yaml", "dot env path")
+	envPath = getEnvArg("DOT_ENV", "dotEnv", ".env.yaml", "dot env path")
+	configFlags = registerConfigFlags(flag.CommandLine)
 	flag.Parse()
+}
 
-	ed, err := os.ReadFile(*envPath)
+// SetupConfig loads the configuration into Conf and configures logging.
+// Values are taken from, in order of precedence: flags, environment
+// variables (and their *_FILE variants), the .env.yaml file and the defaults.
+func SetupConfig() {
+	conf, err := LoadConfig()
 	if err != nil {
-		log.Fatalln(err)
+		fatal("configuration", "err", err)
+	}
+	Conf = conf
+	if err := setupLogging(Conf.Log); err != nil {
+		fatal("setup logging", "err", err)
 	}
+	logger.Debug("configuration", "conf", fmt.Sprintf("%+v", Conf))
+}
 
-	err = yaml.Unmarshal([]byte(ed), &Conf)
-	if err != nil {
-		log.Fatalln(err)
+// LoadConfig reads the configuration file, applies the environment, the
+// flags and the defaults and validates the result
+func LoadConfig() (DotEnv, error) {
+	return loadConfig(*envPath, !isFlagOrEnvSet("dotEnv", "DOT_ENV"), flag.CommandLine, configFlags)
+}
+
+// loadConfig implements LoadConfig for the file path and flagSet; the
+// file may be missing if optional is set
+func loadConfig(path string, optional bool, flagSet *flag.FlagSet, flags map[string]*string) (DotEnv, error) {
+	var conf DotEnv
+	ed, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := yaml.UnmarshalStrict(ed, &conf); err != nil {
+			return conf, fmt.Errorf("%s: %w", path, yamlError(err))
+		}
+	case errors.Is(err, fs.ErrNotExist) && optional:
+		// configuration by environment and flags only
+	default:
+		return conf, err
 	}
 
-	if Conf.Silence.Email == "" {
-		log.Fatal("You must set .env.yaml silence.email")
+	if err := applyEnv(&conf); err != nil {
+		return conf, err
 	}
-	if Conf.Silence.Password == "" {
-		log.Fatal("You must set .env.yaml silence.password")
+	if err := applyFlags(&conf, flagSet, flags); err != nil {
+		return conf, err
 	}
+	conf.setDefaults()
+	return conf, conf.validate()
+}
 
-	if Conf.Influx.Token == "" {
-		log.Fatal("You must set .env.yaml influx.token")
+func (c *DotEnv) setDefaults() {
+	if c.Influx.Bucket == "" {
+		c.Influx.Bucket = "silence"
+	}
+	if c.Influx.Org == "" {
+		c.Influx.Org = "primary"
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = 30 * time.Second
+	}
+	if c.StateDir == "" {
+		c.StateDir = "."
+	}
+	if c.HomeAssistant.StoreDir == "" {
+		c.HomeAssistant.StoreDir = filepath.Join(c.StateDir, "mqtt")
 	}
-	if Conf.Influx.Bucket == "" {
-		Conf.Influx.Bucket = "silence"
+	if c.Trips.SyncInterval == 0 {
+		c.Trips.SyncInterval = time.Hour
 	}
-	if Conf.Influx.Org == "" {
-		Conf.Influx.Org = "primary"
+	if c.Trips.PageSize == 0 {
+		c.Trips.PageSize = 50
 	}
-	if Conf.Influx.Url == "" {
-		log.Fatal("You must set .env.yaml influx.url")
+	if c.Events.ConnectionTimeout == 0 {
+		c.Events.ConnectionTimeout = events.DefaultConnectionTimeout
 	}
+}
+
+var unknownFieldRe = regexp.MustCompile(`field (\S+) not found in type .*`)
+
+// yamlError lists the decoding errors one per line with a readable message
+// for unknown keys
+func yamlError(err error) error {
+	var te *yaml.TypeError
+	if !errors.As(err, &te) {
+		return err
+	}
+	errs := make([]error, len(te.Errors))
+	for i, e := range te.Errors {
+		errs[i] = errors.New(unknownFieldRe.ReplaceAllString(e, "unknown key \"$1\""))
+	}
+	return errors.Join(errs...)
+}
 
-	log.Printf("%#v", Conf)
+// setupLogging configures the default logger and the subsystem loggers. It
+// is called once at startup; a reload only calls logging.Setup, which the
+// subsystem loggers follow.
+func setupLogging(cfg logging.Config) error {
+	if err := logging.Setup(cfg); err != nil {
+		return err
+	}
+	logger = logging.Logger("main")
+	influxLogger = logging.Logger("influx")
+	silence.SetLogger(logging.Logger("silence"))
+	hass.SetLogger(logging.Logger("hass"))
+	events.SetLogger(logging.Logger("events"))
+	return nil
+}
+
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+func isFlagOrEnvSet(arg string, env string) bool {
+	if _, ok := os.LookupEnv(env); ok {
+		return true
+	}
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == arg
+	})
+	return set
 }
 
 func getEnvArg(env string, arg string, dflt string, usage string) *string {
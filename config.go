@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/aeytom/silence-data/hass"
+)
+
+// validate checks the semantics of the configuration. All problems are
+// returned, each prefixed by the yaml path of the offending value.
+func (c *DotEnv) validate() error {
+	var errs []error
+	add := func(key string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Silence.Email == "" {
+		add("silence.email", "required")
+	} else if !strings.Contains(string(c.Silence.Email), "@") {
+		add("silence.email", "not an email address")
+	}
+	if c.Silence.Password == "" {
+		add("silence.password", "required")
+	}
+
+	if c.Influx.Url == "" {
+		add("influx.url", "required")
+	} else if err := validateUrl(c.Influx.Url, "http", "https"); err != nil {
+		add("influx.url", "%v", err)
+	}
+	if c.Influx.Token == "" {
+		add("influx.token", "required")
+	}
+
+	for _, err := range c.HomeAssistant.Validate() {
+		errs = append(errs, fmt.Errorf("home_assistant.%w", err))
+	}
+
+	if c.Http.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Http.Listen); err != nil {
+			add("http.listen", "%v", err)
+		}
+	}
+	if err := c.Log.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("log.%w", err))
+	}
+
+	// the same limits as the PollInterval number of the bridge device
+	minPoll, maxPoll := hass.MinPollInterval*time.Second, hass.MaxPollInterval*time.Second
+	if c.PollInterval < minPoll || c.PollInterval > maxPoll {
+		add("poll_interval", "must be between %s and %s, got %s", minPoll, maxPoll, c.PollInterval)
+	}
+	if c.Trips.SyncInterval > 0 && c.Trips.SyncInterval < time.Minute {
+		add("trips.sync_interval", "must be at least 1m, got %s", c.Trips.SyncInterval)
+	}
+	if c.Trips.PageSize < 1 || c.Trips.PageSize > 1000 {
+		add("trips.page_size", "must be between 1 and 1000, got %d", c.Trips.PageSize)
+	}
+	if c.Events.ConnectionTimeout < c.PollInterval {
+		add("events.connection_timeout", "must not be shorter than poll_interval %s", c.PollInterval)
+	}
+	return errors.Join(errs...)
+}
+
+func validateUrl(s string, schemes ...string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			if u.Host == "" {
+				return fmt.Errorf("missing host in %q", s)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("scheme of %q must be one of %s", s, strings.Join(schemes, ", "))
+}
+
+// configCommand implements "config validate" and "config schema"
+func configCommand(args []string) {
+	sub := ""
+	if len(args) > 0 {
+		sub = args[0]
+	}
+	switch sub {
+	case "validate":
+		if _, err := LoadConfig(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: invalid configuration\n%v\n", *envPath, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: ok\n", *envPath)
+	case "schema":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		schema := jsonSchema(reflect.TypeOf(DotEnv{}))
+		schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+		schema["title"] = "silence-data .env.yaml"
+		if err := enc.Encode(schema); err != nil {
+			fatal("encode schema", "err", err)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "usage: silence-data config validate|schema")
+		os.Exit(2)
+	}
+}
+
+// jsonSchema describes t by its yaml field names; the enum tag lists the
+// allowed values of a string. No field is required, as every value may be
+// set by an environment variable or a flag instead; validate reports the
+// missing ones.
+func jsonSchema(t reflect.Type) map[string]any {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return map[string]any{
+			"type":    "string",
+			"pattern": `^-?([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`,
+		}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		props := map[string]any{}
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			name := yamlName(sf)
+			if name == "" {
+				continue
+			}
+			ps := jsonSchema(sf.Type)
+			if enum := sf.Tag.Get("enum"); enum != "" {
+				ps["enum"] = strings.Split(enum, ",")
+			}
+			props[name] = ps
+		}
+		return map[string]any{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+	}
+	return map[string]any{}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aeytom/silence-data/hass"
+	"github.com/go-yaml/yaml"
+)
+
+func TestYamlError(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []string
+	}{
+		{
+			name: "unknown key",
+			yaml: "influx:\n  tokn: secret\n",
+			want: []string{`line 2: unknown key "tokn"`},
+		},
+		{
+			name: "one line per error",
+			yaml: "pol_interval: 30s\ntrips:\n  page_size: many\n",
+			want: []string{
+				`line 1: unknown key "pol_interval"`,
+				"line 3: cannot unmarshal !!str `many` into int32",
+			},
+		},
+		{
+			name: "syntax error",
+			yaml: "influx: [\n",
+			want: []string{"yaml: line 1: did not find expected node content"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conf DotEnv
+			err := yamlError(yaml.UnmarshalStrict([]byte(tt.yaml), &conf))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if got := strings.Split(err.Error(), "\n"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() DotEnv {
+		var c DotEnv
+		c.Silence.Email = "rider@example.org"
+		c.Silence.Password = "password"
+		c.Influx.Url = "http://localhost:8086"
+		c.Influx.Token = "token"
+		c.HomeAssistant.MqttServer = "tcp://localhost:1883"
+		c.setDefaults()
+		return c
+	}
+	tests := []struct {
+		name   string
+		modify func(c *DotEnv)
+		want   []string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *DotEnv) {},
+		},
+		{
+			name: "required",
+			modify: func(c *DotEnv) {
+				c.Silence.Email, c.Silence.Password = "", ""
+				c.Influx.Url, c.Influx.Token = "", ""
+				c.HomeAssistant.MqttServer = ""
+			},
+			want: []string{
+				"silence.email: required",
+				"silence.password: required",
+				"influx.url: required",
+				"influx.token: required",
+				"home_assistant.mqtt_server: required",
+			},
+		},
+		{
+			name: "malformed values",
+			modify: func(c *DotEnv) {
+				c.Silence.Email = "rider"
+				c.Influx.Url = "ftp://localhost"
+				c.Http.Listen = "9090"
+				c.Log.Level = "verbose"
+			},
+			want: []string{
+				"silence.email: not an email address",
+				`influx.url: scheme of "ftp://localhost" must be one of http, https`,
+				"http.listen: address 9090: missing port in address",
+				`log.level: slog: level string "verbose": unknown name`,
+			},
+		},
+		{
+			name:   "url without host",
+			modify: func(c *DotEnv) { c.Influx.Url = "http://" },
+			want:   []string{`influx.url: missing host in "http://"`},
+		},
+		{
+			name: "nested errors carry the yaml path",
+			modify: func(c *DotEnv) {
+				c.HomeAssistant.Zones = []hass.Zone{{Name: "home", Latitude: 91, Radius: 100}}
+			},
+			want: []string{"home_assistant.zones[0].latitude: must be between -90 and 90, got 91"},
+		},
+		{
+			name:   "poll interval too short",
+			modify: func(c *DotEnv) { c.PollInterval = 5 * time.Second },
+			want:   []string{"poll_interval: must be between 10s and 1h0m0s, got 5s"},
+		},
+		{
+			name: "poll interval too long",
+			modify: func(c *DotEnv) {
+				c.PollInterval = 2 * time.Hour
+				c.Events.ConnectionTimeout = 2 * time.Hour
+			},
+			want: []string{"poll_interval: must be between 10s and 1h0m0s, got 2h0m0s"},
+		},
+		{
+			name: "trips and events",
+			modify: func(c *DotEnv) {
+				c.Trips.SyncInterval = 30 * time.Second
+				c.Trips.PageSize = 1001
+				c.Events.ConnectionTimeout = 10 * time.Second
+			},
+			want: []string{
+				"trips.sync_interval: must be at least 1m, got 30s",
+				"trips.page_size: must be between 1 and 1000, got 1001",
+				"events.connection_timeout: must not be shorter than poll_interval 30s",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(&c)
+			err := c.validate()
+			var got []string
+			if err != nil {
+				got = strings.Split(err.Error(), "\n")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJsonSchema(t *testing.T) {
+	schema := jsonSchema(reflect.TypeOf(DotEnv{}))
+	var walk func(path string, s map[string]any)
+	walk = func(path string, s map[string]any) {
+		if _, ok := s["required"]; ok {
+			t.Errorf("%s: required %v, every key may be set by env or flag", path, s["required"])
+		}
+		props, _ := s["properties"].(map[string]any)
+		for name, p := range props {
+			walk(path+"."+name, p.(map[string]any))
+		}
+	}
+	walk("", schema)
+
+	props := schema["properties"].(map[string]any)
+	if got := props["poll_interval"].(map[string]any)["type"]; got != "string" {
+		t.Errorf("poll_interval: type %v, want string", got)
+	}
+	level := props["log"].(map[string]any)["properties"].(map[string]any)["level"].(map[string]any)
+	if got := level["enum"]; !reflect.DeepEqual(got, []string{"debug", "info", "warn", "error"}) {
+		t.Errorf("log.level: enum %v", got)
+	}
+	if schema["additionalProperties"] != false {
+		t.Error("unknown keys are allowed")
+	}
+}
@@ -0,0 +1,154 @@
+package events
+
+import (
+	"time"
+
+	"github.com/aeytom/silence-data/silence"
+)
+
+const (
+	DefaultConnectionTimeout = time.Hour
+)
+
+type scooterState struct {
+	last      silence.ScooterResp
+	moving    bool
+	connected bool
+	trip      silence.ScooterResp
+	tripStart time.Time
+	charge    silence.ScooterResp
+}
+
+// Detector derives events from consecutive ScooterResp snapshots
+type Detector struct {
+	ConnectionTimeout time.Duration
+	states            map[string]*scooterState
+}
+
+func NewDetector(connectionTimeout time.Duration) *Detector {
+	if connectionTimeout <= 0 {
+		connectionTimeout = DefaultConnectionTimeout
+	}
+	return &Detector{
+		ConnectionTimeout: connectionTimeout,
+		states:            map[string]*scooterState{},
+	}
+}
+
+// Update compares scooter with the previous snapshot of the same scooter and
+// returns the detected events. The first snapshot of a scooter only
+// initialises its state.
+func (d *Detector) Update(scooter silence.ScooterResp, now time.Time) []Event {
+	connected := d.connected(scooter, now)
+	st, ok := d.states[scooter.Id]
+	if !ok {
+		d.states[scooter.Id] = &scooterState{
+			last:      scooter,
+			moving:    isMoving(scooter, scooter),
+			connected: connected,
+			trip:      scooter,
+			tripStart: now,
+			charge:    scooter,
+		}
+		return nil
+	}
+
+	var evs []Event
+	emit := func(t Type, values map[string]interface{}) {
+		evs = append(evs, Event{
+			Type:      t,
+			ScooterId: scooter.Id,
+			Name:      scooter.Name,
+			Time:      now,
+			Values:    values,
+		})
+	}
+	prev := st.last
+
+	if connected != st.connected {
+		if connected {
+			emit(ConnectionRestored, map[string]interface{}{
+				"last_connection": scooter.LastConnection,
+			})
+		} else {
+			emit(ConnectionLost, map[string]interface{}{
+				"last_connection": scooter.LastConnection,
+			})
+		}
+		st.connected = connected
+	}
+
+	moving := isMoving(prev, scooter)
+	if moving && !st.moving {
+		st.trip = prev
+		st.tripStart = now
+		emit(TripStarted, map[string]interface{}{
+			"odometer":  prev.Odometer,
+			"soc":       prev.BatterySoc,
+			"latitude":  prev.LastLocation.Latitude,
+			"longitude": prev.LastLocation.Longitude,
+		})
+	} else if !moving && st.moving {
+		emit(TripEnded, map[string]interface{}{
+			"odometer":     scooter.Odometer,
+			"distance":     scooter.Odometer - st.trip.Odometer,
+			"soc":          scooter.BatterySoc,
+			"battery_used": st.trip.BatterySoc - scooter.BatterySoc,
+			"duration":     now.Sub(st.tripStart).Seconds(),
+			"latitude":     scooter.LastLocation.Latitude,
+			"longitude":    scooter.LastLocation.Longitude,
+		})
+	}
+	st.moving = moving
+
+	if scooter.Charging && !prev.Charging {
+		st.charge = prev
+		emit(ChargingStarted, map[string]interface{}{
+			"soc": scooter.BatterySoc,
+		})
+	} else if !scooter.Charging && prev.Charging {
+		emit(ChargingFinished, map[string]interface{}{
+			"soc":     scooter.BatterySoc,
+			"charged": scooter.BatterySoc - st.charge.BatterySoc,
+		})
+	}
+
+	if scooter.BatteryOut && !prev.BatteryOut {
+		emit(BatteryRemoved, map[string]interface{}{
+			"battery_id": prev.BatteryId,
+			"soc":        prev.BatterySoc,
+		})
+	} else if !scooter.BatteryOut && prev.BatteryOut {
+		emit(BatteryInserted, map[string]interface{}{
+			"battery_id": scooter.BatteryId,
+			"soc":        scooter.BatterySoc,
+		})
+	}
+
+	if scooter.AlarmActivated && !prev.AlarmActivated {
+		emit(AlarmActivated, map[string]interface{}{
+			"latitude":  scooter.LastLocation.Latitude,
+			"longitude": scooter.LastLocation.Longitude,
+		})
+	}
+
+	st.last = scooter
+	return evs
+}
+
+// Forget drops the state of a scooter
+func (d *Detector) Forget(id string) {
+	delete(d.states, id)
+}
+
+func (d *Detector) connected(scooter silence.ScooterResp, now time.Time) bool {
+	lc, err := time.Parse(time.RFC3339, scooter.LastConnection)
+	if err != nil {
+		return false
+	}
+	return now.Sub(lc) < d.ConnectionTimeout
+}
+
+func isMoving(prev silence.ScooterResp, cur silence.ScooterResp) bool {
+	return cur.Velocity > 0 || cur.Odometer > prev.Odometer
+}
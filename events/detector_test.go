@@ -0,0 +1,169 @@
+package events
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aeytom/silence-data/silence"
+)
+
+func TestDetectorUpdate(t *testing.T) {
+	start := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	scooter := func(modify func(s *silence.ScooterResp)) silence.ScooterResp {
+		s := silence.ScooterResp{
+			Id:             "s1",
+			Name:           "Silence",
+			BatterySoc:     80,
+			Odometer:       1000,
+			BatteryId:      7,
+			LastConnection: start.Format(time.RFC3339),
+		}
+		if modify != nil {
+			modify(&s)
+		}
+		return s
+	}
+	type want struct {
+		typ    Type
+		values map[string]interface{}
+	}
+	tests := []struct {
+		name      string
+		snapshots []silence.ScooterResp
+		// step is the time between the snapshots, default one minute
+		step time.Duration
+		want []want
+	}{
+		{
+			name:      "first snapshot",
+			snapshots: []silence.ScooterResp{scooter(func(s *silence.ScooterResp) { s.Velocity = 20; s.Charging = true })},
+		},
+		{
+			name:      "unchanged",
+			snapshots: []silence.ScooterResp{scooter(nil), scooter(nil)},
+		},
+		{
+			name: "trip",
+			snapshots: []silence.ScooterResp{
+				scooter(nil),
+				scooter(func(s *silence.ScooterResp) { s.Velocity = 25; s.Odometer = 1002; s.BatterySoc = 79 }),
+				scooter(func(s *silence.ScooterResp) { s.Velocity = 30; s.Odometer = 1006; s.BatterySoc = 77 }),
+				scooter(func(s *silence.ScooterResp) { s.Odometer = 1006; s.BatterySoc = 76 }),
+			},
+			want: []want{
+				{TripStarted, map[string]interface{}{"odometer": int32(1000), "soc": int16(80), "latitude": 0.0, "longitude": 0.0}},
+				{TripEnded, map[string]interface{}{
+					"odometer": int32(1006), "distance": int32(6), "soc": int16(76), "battery_used": int16(4),
+					"duration": (2 * time.Minute).Seconds(), "latitude": 0.0, "longitude": 0.0,
+				}},
+			},
+		},
+		{
+			name: "odometer change without velocity",
+			snapshots: []silence.ScooterResp{
+				scooter(nil),
+				scooter(func(s *silence.ScooterResp) { s.Odometer = 1001 }),
+			},
+			want: []want{
+				{TripStarted, map[string]interface{}{"odometer": int32(1000), "soc": int16(80), "latitude": 0.0, "longitude": 0.0}},
+			},
+		},
+		{
+			name: "charging",
+			snapshots: []silence.ScooterResp{
+				scooter(func(s *silence.ScooterResp) { s.BatterySoc = 40 }),
+				scooter(func(s *silence.ScooterResp) { s.BatterySoc = 41; s.Charging = true }),
+				scooter(func(s *silence.ScooterResp) { s.BatterySoc = 95 }),
+			},
+			want: []want{
+				{ChargingStarted, map[string]interface{}{"soc": int16(41)}},
+				{ChargingFinished, map[string]interface{}{"soc": int16(95), "charged": int16(55)}},
+			},
+		},
+		{
+			name: "battery removed and inserted",
+			snapshots: []silence.ScooterResp{
+				scooter(nil),
+				scooter(func(s *silence.ScooterResp) { s.BatteryOut = true; s.BatteryId = 0; s.BatterySoc = 0 }),
+				scooter(func(s *silence.ScooterResp) { s.BatteryId = 8; s.BatterySoc = 100 }),
+			},
+			want: []want{
+				{BatteryRemoved, map[string]interface{}{"battery_id": int64(7), "soc": int16(80)}},
+				{BatteryInserted, map[string]interface{}{"battery_id": int64(8), "soc": int16(100)}},
+			},
+		},
+		{
+			name: "alarm activated once",
+			snapshots: []silence.ScooterResp{
+				scooter(nil),
+				scooter(func(s *silence.ScooterResp) { s.AlarmActivated = true; s.LastLocation.Latitude = 52.5 }),
+				scooter(func(s *silence.ScooterResp) { s.AlarmActivated = true; s.LastLocation.Latitude = 52.5 }),
+			},
+			want: []want{
+				{AlarmActivated, map[string]interface{}{"latitude": 52.5, "longitude": 0.0}},
+			},
+		},
+		{
+			name: "connection lost and restored",
+			snapshots: []silence.ScooterResp{
+				scooter(nil),
+				scooter(nil),
+				scooter(func(s *silence.ScooterResp) { s.LastConnection = start.Add(2 * time.Hour).Format(time.RFC3339) }),
+			},
+			step: DefaultConnectionTimeout,
+			want: []want{
+				{ConnectionLost, map[string]interface{}{"last_connection": start.Format(time.RFC3339)}},
+				{ConnectionRestored, map[string]interface{}{"last_connection": start.Add(2 * time.Hour).Format(time.RFC3339)}},
+			},
+		},
+		{
+			name: "unparsable last connection",
+			snapshots: []silence.ScooterResp{
+				scooter(func(s *silence.ScooterResp) { s.LastConnection = "" }),
+				scooter(func(s *silence.ScooterResp) { s.LastConnection = "" }),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step := tt.step
+			if step == 0 {
+				step = time.Minute
+			}
+			d := NewDetector(0)
+			var got []Event
+			for i, s := range tt.snapshots {
+				got = append(got, d.Update(s, start.Add(time.Duration(i)*step))...)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d events %v, want %d", len(got), got, len(tt.want))
+			}
+			for i, w := range tt.want {
+				if got[i].Type != w.typ {
+					t.Errorf("event %d: type %s, want %s", i, got[i].Type, w.typ)
+				}
+				if got[i].ScooterId != "s1" || got[i].Name != "Silence" {
+					t.Errorf("event %d: scooter %q %q", i, got[i].ScooterId, got[i].Name)
+				}
+				if !reflect.DeepEqual(got[i].Values, w.values) {
+					t.Errorf("event %d: values %v, want %v", i, got[i].Values, w.values)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectorForget(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	d := NewDetector(0)
+	if d.ConnectionTimeout != DefaultConnectionTimeout {
+		t.Errorf("timeout %s, want %s", d.ConnectionTimeout, DefaultConnectionTimeout)
+	}
+	d.Update(silence.ScooterResp{Id: "s1"}, now)
+	d.Forget("s1")
+	// after Forget the next snapshot initialises the state again
+	if evs := d.Update(silence.ScooterResp{Id: "s1", Velocity: 10, Charging: true}, now.Add(time.Minute)); len(evs) != 0 {
+		t.Errorf("got events %v after Forget", evs)
+	}
+}
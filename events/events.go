@@ -0,0 +1,107 @@
+package events
+
+import (
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+var logger = slog.Default()
+
+// SetLogger sets the logger of the package
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+type Type string
+
+const (
+	TripStarted        Type = "trip_started"
+	TripEnded          Type = "trip_ended"
+	ChargingStarted    Type = "charging_started"
+	ChargingFinished   Type = "charging_finished"
+	BatteryRemoved     Type = "battery_removed"
+	BatteryInserted    Type = "battery_inserted"
+	AlarmActivated     Type = "alarm_activated"
+	FirmwareChanged    Type = "firmware_changed"
+	ConnectionLost     Type = "connection_lost"
+	ConnectionRestored Type = "connection_restored"
+)
+
+// Types lists all event types; FirmwareChanged is detected from the
+// persisted firmware history, the others by the Detector
+var Types = []Type{
+	TripStarted, TripEnded,
+	ChargingStarted, ChargingFinished,
+	BatteryRemoved, BatteryInserted,
+	AlarmActivated,
+	FirmwareChanged,
+	ConnectionLost, ConnectionRestored,
+}
+
+type Event struct {
+	Type      Type                   `json:"event_type"`
+	ScooterId string                 `json:"scooter_id"`
+	Name      string                 `json:"name,omitempty"`
+	Time      time.Time              `json:"time"`
+	Values    map[string]interface{} `json:"values,omitempty"`
+}
+
+// LogValue omits the location of the event
+func (e Event) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("type", string(e.Type)),
+		slog.String("scooter", e.ScooterId),
+		slog.Time("time", e.Time),
+	}
+	for _, k := range slices.Sorted(maps.Keys(e.Values)) {
+		if k != "latitude" && k != "longitude" {
+			attrs = append(attrs, slog.Any(k, e.Values[k]))
+		}
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// Bus fans out published events to all subscribers
+type Bus struct {
+	mu   sync.RWMutex
+	subs []chan Event
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe returns a channel receiving all events published after the call.
+// Events are dropped for a subscriber whose buffer is full.
+func (b *Bus) Subscribe(size int) <-chan Event {
+	ch := make(chan Event, size)
+	b.mu.Lock()
+	b.subs = append(b.subs, ch)
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *Bus) Publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			logger.Warn("event bus subscriber full, dropping event", "event", e.Type, "scooter", e.ScooterId)
+		}
+	}
+}
+
+// Close closes all subscriber channels
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs {
+		close(ch)
+	}
+	b.subs = nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/aeytom/silence-data/hass"
+	"github.com/aeytom/silence-data/metrics"
+	"github.com/aeytom/silence-data/silence"
+)
+
+var (
+	scooterGauges = map[string]*metrics.Vec{}
+	// metricNames holds the name label exported per scooter id
+	metricNames = map[string]string{}
+	lastPoll    = metrics.NewGauge("silence_last_successful_poll_timestamp_seconds",
+		"Unix time of the last successful scooter poll")
+)
+
+func init() {
+	for _, e := range hass.ScooterEntities {
+		if e.Metric {
+			scooterGauges[e.Key] = metrics.NewGauge(e.MetricName(), e.Help, "id", "name")
+		}
+	}
+}
+
+func sendToMetrics(scooter silence.ScooterResp) {
+	if name, ok := metricNames[scooter.Id]; ok && name != scooter.Name {
+		deleteMetrics(scooter.Id)
+	}
+	metricNames[scooter.Id] = scooter.Name
+	for _, e := range hass.ScooterEntities {
+		if v, ok := e.Float(scooter); ok && e.Metric {
+			scooterGauges[e.Key].Set(v, scooter.Id, scooter.Name)
+		}
+	}
+}
+
+// deleteMetrics removes the series of a removed or renamed scooter
+func deleteMetrics(id string) {
+	for _, g := range scooterGauges {
+		g.Delete(id)
+	}
+	delete(metricNames, id)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/aeytom/silence-data/events"
+	"github.com/aeytom/silence-data/silence"
+	"github.com/aeytom/silence-data/state"
+)
+
+const (
+	firmwareHistoryFile = "firmware-history.json"
+)
+
+type firmwareVersion struct {
+	Version   string    `json:"version"`
+	Released  string    `json:"released,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// FirmwareHistory records the tracker firmware versions seen per scooter.
+// It is persisted, so changes while the daemon was down are detected too.
+type FirmwareHistory struct {
+	path     string
+	versions map[string][]firmwareVersion
+}
+
+func NewFirmwareHistory() *FirmwareHistory {
+	fh := &FirmwareHistory{
+		path:     filepath.Join(Conf.StateDir, firmwareHistoryFile),
+		versions: map[string][]firmwareVersion{},
+	}
+	if err := state.Load(fh.path, &fh.versions); err != nil {
+		logger.Warn("load firmware history", "path", fh.path, "err", err)
+	}
+	return fh
+}
+
+// Observe records the firmware of scooter and returns a FirmwareChanged
+// event if it differs from the last one recorded
+func (fh *FirmwareHistory) Observe(scooter silence.ScooterResp, now time.Time) []events.Event {
+	fw := scooter.TrackingDevice.FirmwareVersion
+	if fw == "" {
+		return nil
+	}
+	hist := fh.versions[scooter.Id]
+	var prev firmwareVersion
+	if len(hist) > 0 {
+		prev = hist[len(hist)-1]
+		if prev.Version == fw {
+			return nil
+		}
+	}
+	fh.versions[scooter.Id] = append(hist, firmwareVersion{
+		Version:   fw,
+		Released:  scooter.TrackingDevice.Timestamp,
+		FirstSeen: now,
+	})
+	if err := state.Save(fh.path, fh.versions); err != nil {
+		logger.Error("save firmware history", "path", fh.path, "err", err)
+	}
+	if prev.Version == "" {
+		return nil
+	}
+	return []events.Event{{
+		Type:      events.FirmwareChanged,
+		ScooterId: scooter.Id,
+		Name:      scooter.Name,
+		Time:      now,
+		Values: map[string]interface{}{
+			"previous": prev.Version,
+			"current":  fw,
+			"released": scooter.TrackingDevice.Timestamp,
+		},
+	}}
+}
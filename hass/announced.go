@@ -0,0 +1,224 @@
+package hass
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/aeytom/silence-data/silence"
+	"github.com/aeytom/silence-data/state"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Announced lists the retained topics published for a device, so they can
+// be cleared once the device disappears
+type Announced struct {
+	Name   string   `json:"name"`
+	Topics []string `json:"topics"`
+}
+
+// LoadAnnounced reads the devices announced by a previous run from path.
+// Later changes are saved to path.
+func (c *Client) LoadAnnounced(path string) error {
+	announced := map[string]Announced{}
+	if err := state.Load(path, &announced); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.announcedPath = path
+	for id, a := range c.announced {
+		announced[id] = a
+	}
+	c.announced = announced
+	return nil
+}
+
+// Announced returns the ids of the announced devices
+func (c *Client) Announced() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ids := make([]string, 0, len(c.announced))
+	for id := range c.announced {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// announce records the retained topics of a device. Topics announced before
+// but no longer used, e.g. after a rename, are cleared.
+func (c *Client) announce(id string, name string, topics ...string) {
+	c.mu.Lock()
+	old := c.announced[id]
+	if old.Name == name && slices.Equal(old.Topics, topics) {
+		c.mu.Unlock()
+		return
+	}
+	c.announced[id] = Announced{Name: name, Topics: topics}
+	c.saveAnnounced()
+	var stale []string
+	for _, t := range old.Topics {
+		if !slices.Contains(topics, t) {
+			stale = append(stale, t)
+			delete(c.sent, t)
+		}
+	}
+	c.mu.Unlock()
+	for _, t := range stale {
+		c.clear(t)
+	}
+}
+
+// Forget clears the retained discovery, availability and state of a device
+func (c *Client) Forget(id string) {
+	c.forget(id, false)
+}
+
+// forget clears the retained topics of a device; topics still in use are
+// kept unless all is set
+func (c *Client) forget(id string, all bool) {
+	c.mu.Lock()
+	a, ok := c.announced[id]
+	delete(c.announced, id)
+	for topic := range c.sent {
+		if slices.Contains(a.Topics, topic) {
+			delete(c.sent, topic)
+		}
+	}
+	c.saveAnnounced()
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	logger.Info("removing device from home assistant", "id", id, "name", a.Name)
+	for _, t := range a.Topics {
+		if all || !c.inUse(t) {
+			c.clear(t)
+		}
+	}
+}
+
+// inUse reports whether topic is used by the bridge or an announced device,
+// e.g. the bridge topics after a change of the client id
+func (c *Client) inUse(topic string) bool {
+	cfg := c.config()
+	if topic == cfg.bridgeTopic("state") || topic == cfg.bridgeTopic("availability") {
+		return true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, a := range c.announced {
+		if slices.Contains(a.Topics, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prune forgets the announced scooters missing in scooters and returns
+// their ids. The bridge device is kept.
+func (c *Client) Prune(scooters []silence.ScooterResp) []string {
+	bridge := c.BridgeId()
+	var gone []string
+	for _, id := range c.Announced() {
+		if id == bridge || slices.ContainsFunc(scooters, func(s silence.ScooterResp) bool { return s.Id == id }) {
+			continue
+		}
+		c.Remove(id)
+		gone = append(gone, id)
+	}
+	return gone
+}
+
+// FindRetained adds the devices linked to this bridge that have retained
+// discovery configs on the broker, including the bridge, to the announced
+// devices and returns their ids
+func (c *Client) FindRetained(wait time.Duration) []string {
+	bridge := c.BridgeId()
+	topic := fmt.Sprintf("%s/+/+/config", c.config().DiscoveryPrefix)
+	found := map[string][]string{}
+	msgs := make(chan mqtt.Message, 256)
+	handler := func(_ mqtt.Client, msg mqtt.Message) {
+		if !msg.Retained() {
+			return
+		}
+		select {
+		case msgs <- msg:
+		default:
+			logger.Warn("too many retained discovery configs", "topic", msg.Topic())
+		}
+	}
+	if t := c.mqtt().Subscribe(topic, 1, handler); t.Wait() && t.Error() != nil {
+		logger.Error("subscribe failed", "topic", topic, "err", t.Error())
+		return nil
+	}
+	timeout := time.After(wait)
+	for done := false; !done; {
+		select {
+		case msg := <-msgs:
+			if id, ok := linkedDevice(msg.Payload(), bridge); ok {
+				found[id] = append(found[id], msg.Topic())
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	c.mqtt().Unsubscribe(topic).Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]string, 0, len(found))
+	for id, topics := range found {
+		a := c.announced[id]
+		for _, t := range topics {
+			if !slices.Contains(a.Topics, t) {
+				a.Topics = append(a.Topics, t)
+			}
+		}
+		c.announced[id] = a
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// linkedDevice returns the id of the device of a discovery config if it is
+// the bridge or linked to it
+func linkedDevice(payload []byte, bridge string) (string, bool) {
+	var dev struct {
+		Device HaDevice `json:"device"`
+	}
+	if json.Unmarshal(payload, &dev) != nil || len(dev.Device.Identifiers) == 0 {
+		return "", false
+	}
+	id := dev.Device.Identifiers[0]
+	return id, id == bridge || dev.Device.ViaDevice == bridge
+}
+
+// Purge clears all retained topics of the given devices
+func (c *Client) Purge(ids []string) {
+	for _, id := range ids {
+		c.forget(id, true)
+	}
+}
+
+// clear removes a retained message by publishing an empty retained message
+func (c *Client) clear(topic string) {
+	t := c.mqtt().Publish(topic, 1, true, []byte{})
+	if !t.WaitTimeout(5*time.Second) || t.Error() != nil {
+		publishFailures.Inc()
+		logger.Error("clear retained message failed", "topic", topic, "err", t.Error())
+	}
+}
+
+// saveAnnounced persists the announced devices; c.mu must be held
+func (c *Client) saveAnnounced() {
+	if c.announcedPath == "" {
+		return
+	}
+	if err := state.Save(c.announcedPath, c.announced); err != nil {
+		logger.Error("save announced devices", "path", c.announcedPath, "err", err)
+	}
+}
@@ -0,0 +1,37 @@
+package hass
+
+import "testing"
+
+func TestFindRetainedMatchesBridge(t *testing.T) {
+	c := &Client{cfg: toolConfig(Config{MqttClientId: "garage"}).withDefaults()}
+	if got := c.cfg.clientId(); got != "garage-cli" {
+		t.Errorf("tool client id %q, want garage-cli", got)
+	}
+	bridge := c.BridgeId()
+	if bridge != "garage" {
+		t.Fatalf("bridge id %q, want the configured id garage", bridge)
+	}
+
+	tests := []struct {
+		name    string
+		payload string
+		id      string
+		ok      bool
+	}{
+		{"bridge", `{"device":{"identifiers":["garage"]}}`, "garage", true},
+		{"scooter via bridge", `{"device":{"identifiers":["s1"],"via_device":"garage"}}`, "s1", true},
+		{"other bridge", `{"device":{"identifiers":["s2"],"via_device":"garage-cli"}}`, "s2", false},
+		{"foreign device", `{"device":{"identifiers":["lamp"]}}`, "lamp", false},
+		{"no identifiers", `{"device":{"via_device":"garage"}}`, "", false},
+		{"invalid json", `{`, "", false},
+		{"empty", ``, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ok := linkedDevice([]byte(tt.payload), bridge)
+			if id != tt.id || ok != tt.ok {
+				t.Errorf("linkedDevice = %q, %v, want %q, %v", id, ok, tt.id, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package hass
+
+import (
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	CommandPoll         = "poll"
+	CommandPollInterval = "poll_interval"
+	CommandPause        = "pause"
+
+	MinPollInterval = 10
+	MaxPollInterval = 3600
+)
+
+// BridgeState is published to <base_topic>/bridge/state
+type BridgeState struct {
+	PollInterval   float64 `json:"poll_interval"`
+	Paused         bool    `json:"paused"`
+	Version        string  `json:"version"`
+	Started        string  `json:"started"`
+	LastPoll       string  `json:"last_poll,omitempty"`
+	ApiErrors      float64 `json:"api_errors"`
+	TokenExpiry    string  `json:"token_expiry,omitempty"`
+	MqttReconnects int     `json:"mqtt_reconnects"`
+	InfluxBacklog  int     `json:"influx_backlog"`
+}
+
+// Command is a command sent by Home Assistant to the bridge
+type Command struct {
+	Name    string
+	Payload string
+}
+
+// BridgeId identifies the bridge device in Home Assistant
+func (c *Client) BridgeId() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cfg.MqttClientId != "" {
+		return c.cfg.MqttClientId
+	}
+	return "silence-data"
+}
+
+// SendBridgeDiscovery publishes the bridge device with its command entities
+func (c *Client) SendBridgeDiscovery(version string) {
+	id := c.BridgeId()
+	cfg := c.config()
+	dev := DeviceDiscovery{
+		StateTopic:   cfg.bridgeTopic("state"),
+		Availability: []Availability{cfg.bridgeAvailability()},
+		Qos:          int16(cfg.Qos),
+		Device: HaDevice{
+			Identifiers:  []string{id},
+			Manufacturer: "aeytom",
+			Model:        "silence-data",
+			Name:         "Silence Data Bridge",
+			SwVersion:    version,
+		},
+		Origin: Origin{
+			Name:       "silence-data",
+			SwVersion:  version,
+			SupportUrl: "https://github.com/aeytom/silence-data",
+		},
+		Components: map[string]DiscoveryPayload{
+			"Refresh": {
+				Platform:     "button",
+				Name:         "Refresh",
+				Icon:         "mdi:refresh",
+				CommandTopic: cfg.bridgeCommandTopic(CommandPoll),
+				PayloadPress: "PRESS",
+				UniqueId:     id + "-Refresh",
+			},
+			"PollInterval": {
+				Platform:          "number",
+				Name:              "PollInterval",
+				EntityCategory:    "config",
+				DeviceClass:       "duration",
+				UnitOfMeasurement: "s",
+				Min:               MinPollInterval,
+				Max:               MaxPollInterval,
+				Step:              1,
+				Mode:              "box",
+				CommandTopic:      cfg.bridgeCommandTopic(CommandPollInterval),
+				UniqueId:          id + "-PollInterval",
+				ValueTemplate:     "{{ value_json.poll_interval }}",
+			},
+			"PausePolling": {
+				Platform:      "switch",
+				Name:          "PausePolling",
+				Icon:          "mdi:pause",
+				CommandTopic:  cfg.bridgeCommandTopic(CommandPause),
+				PayloadOn:     "ON",
+				PayloadOff:    "OFF",
+				UniqueId:      id + "-PausePolling",
+				ValueTemplate: "{{ 'ON' if value_json.paused else 'OFF' }}",
+			},
+			"Version": {
+				Platform:       "sensor",
+				Name:           "Version",
+				Icon:           "mdi:tag-outline",
+				EntityCategory: "diagnostic",
+				UniqueId:       id + "-Version",
+				ValueTemplate:  "{{ value_json.version }}",
+			},
+			"Started": {
+				Platform:       "sensor",
+				DeviceClass:    "timestamp",
+				Name:           "Started",
+				EntityCategory: "diagnostic",
+				UniqueId:       id + "-Started",
+				ValueTemplate:  "{{ value_json.started }}",
+			},
+			"LastPoll": {
+				Platform:       "sensor",
+				DeviceClass:    "timestamp",
+				Name:           "LastPoll",
+				EntityCategory: "diagnostic",
+				UniqueId:       id + "-LastPoll",
+				ValueTemplate:  "{{ value_json.last_poll | default(None) }}",
+			},
+			"ApiErrors": {
+				Platform:       "sensor",
+				Name:           "ApiErrors",
+				Icon:           "mdi:alert-circle-outline",
+				StateClass:     "total_increasing",
+				EntityCategory: "diagnostic",
+				UniqueId:       id + "-ApiErrors",
+				ValueTemplate:  "{{ value_json.api_errors }}",
+			},
+			"TokenExpiry": {
+				Platform:       "sensor",
+				DeviceClass:    "timestamp",
+				Name:           "TokenExpiry",
+				EntityCategory: "diagnostic",
+				UniqueId:       id + "-TokenExpiry",
+				ValueTemplate:  "{{ value_json.token_expiry | default(None) }}",
+			},
+			"MqttReconnects": {
+				Platform:       "sensor",
+				Name:           "MqttReconnects",
+				Icon:           "mdi:lan-disconnect",
+				StateClass:     "total_increasing",
+				EntityCategory: "diagnostic",
+				UniqueId:       id + "-MqttReconnects",
+				ValueTemplate:  "{{ value_json.mqtt_reconnects }}",
+			},
+			"InfluxBacklog": {
+				Platform:       "sensor",
+				Name:           "InfluxBacklog",
+				Icon:           "mdi:database-clock-outline",
+				StateClass:     "measurement",
+				EntityCategory: "diagnostic",
+				UniqueId:       id + "-InfluxBacklog",
+				ValueTemplate:  "{{ value_json.influx_backlog }}",
+			},
+		},
+	}
+
+	c.publishDevice(id, dev.Device.Name, dev, false, cfg.bridgeTopic("state"), cfg.bridgeTopic("availability"))
+}
+
+// bridgeAvailability is offline as soon as the bridge disconnects or dies
+func (cfg Config) bridgeAvailability() Availability {
+	return Availability{Topic: cfg.bridgeTopic("availability")}
+}
+
+func (c *Client) SendBridgeState(st BridgeState) {
+	cfg := c.config()
+	c.Send(cfg.bridgeTopic("state"), cfg.Qos, true, st)
+}
+
+// SubscribeCommands returns the commands sent to the bridge entities
+func (c *Client) SubscribeCommands() (chan Command, error) {
+	cmds := make(chan Command, 8)
+	err := c.Handle(c.config().bridgeCommandTopic("+"), 0, func(msg mqtt.Message) {
+		// <base>/bridge/<command>/set
+		if parts := strings.Split(msg.Topic(), "/"); len(parts) >= 2 {
+			cmds <- Command{Name: parts[len(parts)-2], Payload: string(msg.Payload())}
+		}
+	})
+	return cmds, err
+}
@@ -0,0 +1,218 @@
+package hass
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aeytom/silence-data/metrics"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// subscriptionQueueSize is the number of messages buffered per
+	// subscription before messages are dropped
+	subscriptionQueueSize = 16
+
+	publishWorkers   = 4
+	publishQueueSize = 256
+	// enqueueTimeout is how long Send blocks on a full publish queue
+	enqueueTimeout = 5 * time.Second
+	publishTimeout = 10 * time.Second
+)
+
+var (
+	droppedMessages = metrics.NewCounter("silence_mqtt_dropped_messages_total",
+		"Received MQTT messages dropped because the handler queue was full", "topic")
+	droppedPublishes = metrics.NewCounter("silence_mqtt_dropped_publishes_total",
+		"MQTT messages not published because the publish queue was full")
+)
+
+// Handler handles the messages of a subscription
+type Handler func(msg mqtt.Message)
+
+// subscription queues the messages of a topic filter for its handler, so a
+// slow handler never blocks the paho router
+type subscription struct {
+	qos      byte
+	queue    chan mqtt.Message
+	done     chan struct{}
+	callback mqtt.MessageHandler
+}
+
+type publication struct {
+	topic   string
+	qos     byte
+	retain  bool
+	payload []byte
+}
+
+// Handle registers handler for the messages of a topic filter. Messages are
+// dropped while the queue of the handler is full.
+func (c *Client) Handle(topic string, qos byte, handler Handler) error {
+	sub := &subscription{
+		qos:   qos,
+		queue: make(chan mqtt.Message, subscriptionQueueSize),
+		done:  make(chan struct{}),
+	}
+	sub.callback = func(_ mqtt.Client, msg mqtt.Message) {
+		select {
+		case <-sub.done:
+		case sub.queue <- msg:
+		default:
+			droppedMessages.Inc(topic)
+			logger.Warn("handler queue full, dropping message", "topic", msg.Topic())
+		}
+	}
+	go func() {
+		for {
+			select {
+			case <-sub.done:
+				return
+			case msg := <-sub.queue:
+				handler(msg)
+			}
+		}
+	}()
+
+	c.mu.Lock()
+	if old, ok := c.subs[topic]; ok {
+		close(old.done)
+	}
+	c.subs[topic] = sub
+	c.mu.Unlock()
+	if token := c.mqtt().Subscribe(topic, qos, sub.callback); token.Wait() && token.Error() != nil {
+		c.mu.Lock()
+		if c.subs[topic] == sub {
+			delete(c.subs, topic)
+			close(sub.done)
+		}
+		c.mu.Unlock()
+		return fmt.Errorf("subscribe %s: %w", topic, token.Error())
+	}
+	return nil
+}
+
+// Subscribe returns the messages of a topic filter
+func (c *Client) Subscribe(topic string, qos byte) (<-chan mqtt.Message, error) {
+	msgs := make(chan mqtt.Message)
+	if err := c.Handle(topic, qos, func(msg mqtt.Message) { msgs <- msg }); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// Unsubscribe removes a subscription made by Handle or Subscribe
+func (c *Client) Unsubscribe(topic string) {
+	c.mu.Lock()
+	sub, ok := c.subs[topic]
+	delete(c.subs, topic)
+	c.mu.Unlock()
+	if ok {
+		close(sub.done)
+		c.mqtt().Unsubscribe(topic)
+	}
+}
+
+// moveSubscription moves an existing subscription to another topic
+func (c *Client) moveSubscription(from string, to string) {
+	c.mu.Lock()
+	sub, ok := c.subs[from]
+	if !ok || from == to {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.subs, from)
+	c.subs[to] = sub
+	c.mu.Unlock()
+	c.mqtt().Unsubscribe(from)
+	c.mqtt().Subscribe(to, sub.qos, sub.callback)
+}
+
+func (c *Client) Send(topic string, qos byte, retain bool, payload interface{}) {
+	switch p := payload.(type) {
+	case string:
+		c.sendBytes(topic, qos, retain, []byte(p))
+	case []byte:
+		c.sendBytes(topic, qos, retain, p)
+	case bytes.Buffer:
+		c.sendBytes(topic, qos, retain, p.Bytes())
+	default:
+		if msg, err := json.Marshal(p); err == nil {
+			c.sendBytes(topic, qos, retain, msg)
+		} else {
+			logger.Error("marshal payload", "topic", topic, "err", err)
+		}
+	}
+}
+
+// sendBytes queues a message for the publish workers. It blocks while the
+// queue is full and drops the message after enqueueTimeout.
+func (c *Client) sendBytes(topic string, qos byte, retain bool, msg []byte) {
+	logger.Debug("publish", "topic", topic, "size", len(msg))
+	c.pending.Add(1)
+	select {
+	case c.publishes <- publication{topic: topic, qos: qos, retain: retain, payload: msg}:
+	case <-time.After(enqueueTimeout):
+		c.done()
+		droppedPublishes.Inc()
+		logger.Error("publish queue full, dropping message", "topic", topic)
+	}
+}
+
+// startPublishers starts the fixed pool of publish workers
+func (c *Client) startPublishers() {
+	for range publishWorkers {
+		go func() {
+			for p := range c.publishes {
+				c.publish(p)
+				c.done()
+			}
+		}()
+	}
+}
+
+// done marks a queued message as handled
+func (c *Client) done() {
+	if c.pending.Add(-1) == 0 {
+		select {
+		case c.idle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *Client) publish(p publication) {
+	client := c.mqtt()
+	t := client.Publish(p.topic, p.qos, p.retain, p.payload)
+	if p.qos > 0 && !client.IsConnectionOpen() && t.Error() == nil {
+		// stored and sent after reconnecting
+		return
+	}
+	if !t.WaitTimeout(publishTimeout) {
+		publishFailures.Inc()
+		logger.Error("publish timed out", "topic", p.topic)
+	} else if t.Error() != nil {
+		publishFailures.Inc()
+		logger.Error("publish failed", "topic", p.topic, "err", t.Error())
+	}
+}
+
+// PublishBacklog returns the number of queued messages
+func (c *Client) PublishBacklog() int {
+	return len(c.publishes)
+}
+
+// flush waits up to timeout for the queued messages to be published
+func (c *Client) flush(timeout time.Duration) {
+	deadline := time.After(timeout)
+	for c.pending.Load() > 0 {
+		select {
+		case <-c.idle:
+		case <-deadline:
+			logger.Warn("publish queue not empty on disconnect", "backlog", c.PublishBacklog())
+			return
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package hass
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/aeytom/silence-data/silence"
+)
+
+// Entity declares a value of a scooter once for Home Assistant, Prometheus
+// and InfluxDB. Entities without Platform are not announced to Home
+// Assistant.
+type Entity struct {
+	Key         string // component key and name in Home Assistant, e.g. BatterySoc
+	Field       string // path of the value in silence.ScooterResp, e.g. LastLocation.Time
+	Platform    string
+	DeviceClass string
+	StateClass  string
+	Unit        string
+	Icon        string
+	Category    string
+	Help        string
+	Metric      bool   // export as gauge silence_scooter_<state key>_<unit>
+	Influx      string // field of the influxdb2 scooter measurement
+}
+
+func init() {
+	for _, e := range ScooterEntities {
+		e.field()
+	}
+}
+
+// ScooterEntities are the values published for each scooter
+var ScooterEntities = []Entity{
+	{Key: "LastReportTime", Field: "LastReportTime", Platform: "sensor", DeviceClass: "timestamp"},
+	{Key: "LastLocationTime", Field: "LastLocation.Time", Platform: "sensor", DeviceClass: "timestamp"},
+	{Key: "LastConnectionTime", Field: "LastConnection", Platform: "sensor", DeviceClass: "timestamp"},
+	{Key: "BatterySoc", Field: "BatterySoc", Platform: "sensor", DeviceClass: "battery", StateClass: "measurement", Unit: "%",
+		Help: "Battery state of charge", Metric: true, Influx: "bsoc"},
+	{Key: "BatteryTemperature", Field: "BatteryTemperature", Platform: "sensor", DeviceClass: "temperature", StateClass: "measurement", Unit: "°C",
+		Help: "Battery temperature", Metric: true, Influx: "btemp"},
+	{Key: "MotorTemperature", Field: "MotorTemperature", Platform: "sensor", DeviceClass: "temperature", StateClass: "measurement", Unit: "°C",
+		Help: "Motor temperature", Metric: true, Influx: "mtemp"},
+	{Key: "InverterTemperature", Field: "InverterTemperature", Platform: "sensor", DeviceClass: "temperature", StateClass: "measurement", Unit: "°C",
+		Help: "Inverter temperature", Metric: true, Influx: "itemp"},
+	{Key: "Odometer", Field: "Odometer", Platform: "sensor", DeviceClass: "distance", StateClass: "total_increasing", Unit: "km",
+		Help: "Odometer", Metric: true, Influx: "odo"},
+	{Key: "Range", Field: "Range", Platform: "sensor", DeviceClass: "distance", StateClass: "measurement", Unit: "km",
+		Help: "Estimated range", Metric: true, Influx: "range"},
+	{Key: "Velocity", Field: "Velocity", Platform: "sensor", DeviceClass: "speed", StateClass: "measurement", Unit: "km/h",
+		Help: "Velocity", Metric: true, Influx: "velocity"},
+	{Key: "Charging", Field: "Charging", Platform: "binary_sensor", DeviceClass: "battery_charging"},
+	{Key: "Alarm", Field: "AlarmActivated", Platform: "binary_sensor", DeviceClass: "tamper"},
+	{Key: "BatteryOut", Field: "BatteryOut", Platform: "binary_sensor", Icon: "mdi:battery-off-outline"},
+	{Key: "Status", Field: "Status", Platform: "sensor", Icon: "mdi:information-outline"},
+	{Key: "BatteryId", Field: "BatteryId", Platform: "sensor", Icon: "mdi:identifier"},
+	{Key: "Altitude", Field: "LastLocation.Altitude", Platform: "sensor", DeviceClass: "distance", StateClass: "measurement", Unit: "m",
+		Help: "Altitude of the last GPS fix", Metric: true},
+	{Key: "GpsSpeed", Field: "LastLocation.CurrentSpeed", Platform: "sensor", DeviceClass: "speed", StateClass: "measurement", Unit: "km/h",
+		Help: "Speed of the last GPS fix", Metric: true, Influx: "speed"},
+	{Key: "Latitude", Field: "LastLocation.Latitude", Unit: "°", Help: "Latitude of the last GPS fix", Metric: true, Influx: "lat"},
+	{Key: "Longitude", Field: "LastLocation.Longitude", Unit: "°", Help: "Longitude of the last GPS fix", Metric: true, Influx: "lon"},
+	{Key: "Plate", Field: "Plate", Platform: "sensor", Icon: "mdi:card-text-outline", Category: "diagnostic"},
+	{Key: "Imei", Field: "Imei", Platform: "sensor", Icon: "mdi:identifier", Category: "diagnostic"},
+	{Key: "FrameNo", Field: "FrameNo", Platform: "sensor", Icon: "mdi:identifier", Category: "diagnostic"},
+	{Key: "Firmware", Field: "TrackingDevice.FirmwareVersion", Platform: "sensor", Icon: "mdi:chip", Category: "diagnostic"},
+	{Key: "FirmwareReleased", Field: "TrackingDevice.Timestamp", Platform: "sensor", DeviceClass: "timestamp", Category: "diagnostic"},
+}
+
+// timestamp maps a missing time to null, which Home Assistant shows as unknown
+func timestamp(t string) any {
+	if t == "" {
+		return nil
+	}
+	return t
+}
+
+// scooterEntity returns the entity of ScooterEntities with key
+func scooterEntity(key string) Entity {
+	for _, e := range ScooterEntities {
+		if e.Key == key {
+			return e
+		}
+	}
+	panic("hass: no scooter entity " + key)
+}
+
+// field returns the index of Field in silence.ScooterResp and its path in
+// the JSON of the scooter, which is the state payload
+func (e Entity) field() ([]int, string) {
+	t := reflect.TypeFor[silence.ScooterResp]()
+	var index []int
+	var path []string
+	for _, name := range strings.Split(e.Field, ".") {
+		sf, ok := t.FieldByName(name)
+		if !ok {
+			panic(fmt.Sprintf("hass: entity %s: no field %s in silence.ScooterResp", e.Key, e.Field))
+		}
+		index = append(index, sf.Index...)
+		tag, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		path = append(path, tag)
+		t = sf.Type
+	}
+	return index, strings.Join(path, ".")
+}
+
+// Value returns the value of the entity; empty timestamps are nil
+func (e Entity) Value(scooter silence.ScooterResp) any {
+	if e.Field == "" {
+		return nil
+	}
+	index, _ := e.field()
+	v := reflect.ValueOf(scooter).FieldByIndex(index).Interface()
+	if t, ok := v.(string); ok && e.DeviceClass == "timestamp" {
+		return timestamp(t)
+	}
+	return v
+}
+
+// StatePath returns the path of the entity in the state payload: the JSON
+// name of Field, or StateKey for entities without Field
+func (e Entity) StatePath() string {
+	if e.Field == "" {
+		return e.StateKey()
+	}
+	_, path := e.field()
+	return path
+}
+
+// StateKey returns the key of the entity in the state payload, the snake
+// case Key
+func (e Entity) StateKey() string {
+	var b strings.Builder
+	for i, r := range e.Key {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+var unitSuffixes = map[string]string{
+	"%":    "percent",
+	"°C":   "celsius",
+	"km":   "kilometers",
+	"km/h": "kmh",
+	"m":    "meters",
+	"°":    "degrees",
+}
+
+// MetricName returns the name of the Prometheus gauge
+func (e Entity) MetricName() string {
+	name := "silence_scooter_" + e.StateKey()
+	if suffix := unitSuffixes[e.Unit]; suffix != "" {
+		name += "_" + suffix
+	}
+	return name
+}
+
+// Float returns the value of the entity as number; booleans are 0 or 1
+func (e Entity) Float(scooter silence.ScooterResp) (float64, bool) {
+	switch v := e.Value(scooter).(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Discovery returns the discovery component of the entity. Values missing
+// from the state payload, which omits empty API fields, are off, zero or
+// unknown.
+func (e Entity) Discovery(uniquePrefix string) DiscoveryPayload {
+	path := e.StatePath()
+	tmpl := fmt.Sprintf("{{ value_json.%s }}", path)
+	switch {
+	case e.Platform == "binary_sensor":
+		tmpl = fmt.Sprintf("{{ 'ON' if value_json.%s | default(false) else 'OFF' }}", path)
+	case e.DeviceClass == "timestamp":
+		tmpl = fmt.Sprintf("{{ value_json.%s | default(None, true) }}", path)
+	case e.Field == "":
+	default:
+		switch e.Value(silence.ScooterResp{}).(type) {
+		case string:
+			tmpl = fmt.Sprintf("{{ value_json.%s | default('') }}", path)
+		case int16, int32, int64, float64:
+			tmpl = fmt.Sprintf("{{ value_json.%s | default(0) }}", path)
+		}
+	}
+	return DiscoveryPayload{
+		Platform:          e.Platform,
+		Name:              e.Key,
+		DeviceClass:       e.DeviceClass,
+		StateClass:        e.StateClass,
+		UnitOfMeasurement: e.Unit,
+		Icon:              e.Icon,
+		EntityCategory:    e.Category,
+		UniqueId:          uniquePrefix + "-" + e.Key,
+		ValueTemplate:     tmpl,
+	}
+}
+
+// InfluxFields returns the fields of the influxdb2 scooter measurement
+func InfluxFields(scooter silence.ScooterResp) map[string]any {
+	fields := map[string]any{}
+	for _, e := range ScooterEntities {
+		if e.Influx != "" {
+			fields[e.Influx] = e.Value(scooter)
+		}
+	}
+	return fields
+}
+
+// ScooterMeter announces a scooter with the entities of ScooterEntities and
+// publishes its state
+type ScooterMeter struct {
+	Scooter silence.ScooterResp
+	handle  *Handle
+}
+
+// HassRegister publishes the discovery of the scooter if it changed since it
+// was last sent
+func (m *ScooterMeter) HassRegister(c *Client) *Handle {
+	dev := c.publishScooter(m.Scooter, true)
+	m.handle = &Handle{Mqtt: c, Object: dev}
+	return m.handle
+}
+
+// HassSendValue publishes the availability, state and location of the scooter
+func (m *ScooterMeter) HassSendValue() {
+	SendStatus(m.handle.Mqtt, m.Scooter)
+	SendLocation(m.handle.Mqtt, m.Scooter)
+}
@@ -0,0 +1,132 @@
+package hass
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+
+	"github.com/aeytom/silence-data/silence"
+)
+
+const (
+	// DefaultGpsAccuracy is reported as gps_accuracy, as the API does not
+	// report the accuracy of a fix
+	DefaultGpsAccuracy = 10
+	// minCourseDistance is the distance in meters a scooter must move before
+	// the course is updated
+	minCourseDistance = 20
+
+	earthRadius = 6371000
+)
+
+// Zone is a named circle; the location attributes report the first zone a
+// scooter is in
+type Zone struct {
+	Name      string  `yaml:"name" json:"name"`
+	Latitude  float64 `yaml:"latitude" json:"latitude"`
+	Longitude float64 `yaml:"longitude" json:"longitude"`
+	Radius    float64 `yaml:"radius" json:"radius"`
+}
+
+// String omits the coordinates of the zone, which are often the home of
+// the user
+func (z Zone) String() string {
+	return fmt.Sprintf("{Name:%s Radius:%g}", z.Name, z.Radius)
+}
+
+func (z Zone) GoString() string { return z.String() }
+
+// LogValue omits the coordinates of the zone
+func (z Zone) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("name", z.Name), slog.Float64("radius", z.Radius))
+}
+
+// Validate returns the zone configuration problems
+func (z Zone) Validate() []error {
+	var errs []error
+	if z.Name == "" {
+		errs = append(errs, errors.New("name: required"))
+	}
+	if z.Latitude < -90 || z.Latitude > 90 {
+		errs = append(errs, fmt.Errorf("latitude: must be between -90 and 90, got %g", z.Latitude))
+	}
+	if z.Longitude < -180 || z.Longitude > 180 {
+		errs = append(errs, fmt.Errorf("longitude: must be between -180 and 180, got %g", z.Longitude))
+	}
+	if z.Radius <= 0 {
+		errs = append(errs, fmt.Errorf("radius: must be positive, got %g", z.Radius))
+	}
+	return errs
+}
+
+// Contains reports whether the position is inside the zone
+func (z Zone) Contains(lat float64, lon float64) bool {
+	return distance(z.Latitude, z.Longitude, lat, lon) <= z.Radius
+}
+
+// zoneOf returns the name of the first zone containing the position, or ""
+func zoneOf(zones []Zone, lat float64, lon float64) string {
+	for _, z := range zones {
+		if z.Contains(lat, lon) {
+			return z.Name
+		}
+	}
+	return ""
+}
+
+// distance returns the great-circle distance in meters
+func distance(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	p1, p2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dp, dl := p2-p1, (lon2-lon1)*math.Pi/180
+	a := math.Sin(dp/2)*math.Sin(dp/2) + math.Cos(p1)*math.Cos(p2)*math.Sin(dl/2)*math.Sin(dl/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// bearing returns the initial course from the first to the second position
+// in degrees clockwise from north
+func bearing(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	p1, p2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dl := (lon2 - lon1) * math.Pi / 180
+	y := math.Sin(dl) * math.Cos(p2)
+	x := math.Cos(p1)*math.Sin(p2) - math.Sin(p1)*math.Cos(p2)*math.Cos(dl)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// locationAttributes returns the device tracker attributes of a scooter.
+// The course is derived from the previous fix.
+func (c *Client) locationAttributes(scooter silence.ScooterResp) DeviceTrackerAttributes {
+	cfg := c.config()
+	loc := scooter.LastLocation
+	ja := DeviceTrackerAttributes{
+		SourceType:  "gps",
+		GpsAccuracy: cfg.GpsAccuracy,
+		Latitude:    loc.Latitude,
+		Longitude:   loc.Longitude,
+		Altitude:    loc.Altitude,
+		Speed:       loc.CurrentSpeed,
+		Time:        loc.Time,
+		Zone:        zoneOf(cfg.Zones, loc.Latitude, loc.Longitude),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev, ok := c.fixes[scooter.Id]
+	switch {
+	case !ok:
+	case distance(prev.Latitude, prev.Longitude, ja.Latitude, ja.Longitude) >= minCourseDistance:
+		ja.Course = bearing(prev.Latitude, prev.Longitude, ja.Latitude, ja.Longitude)
+	default:
+		// too close to tell, keep the course and the reference position
+		ja.Course = prev.Course
+		c.fixes[scooter.Id] = DeviceTrackerAttributes{Latitude: prev.Latitude, Longitude: prev.Longitude, Course: prev.Course}
+		return ja
+	}
+	c.fixes[scooter.Id] = ja
+	return ja
+}
+
+func SendLocation(c *Client, scooter silence.ScooterResp) {
+	cfg := c.config()
+	c.Send(c.scooterTopics(scooter).Location, cfg.stateQos(), cfg.RetainState, c.locationAttributes(scooter))
+}
@@ -0,0 +1,78 @@
+package hass
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestZoneOf(t *testing.T) {
+	zones := []Zone{
+		{Name: "home", Latitude: 52.5163, Longitude: 13.3777, Radius: 100},
+		{Name: "work", Latitude: 52.5200, Longitude: 13.4049, Radius: 150},
+		{Name: "city", Latitude: 52.5200, Longitude: 13.4050, Radius: 5000},
+	}
+	tests := []struct {
+		name     string
+		zones    []Zone
+		lat, lon float64
+		want     string
+	}{
+		{"center", zones, 52.5163, 13.3777, "home"},
+		{"inside radius", zones, 52.5170, 13.3777, "home"}, // ~78m north
+		{"first match wins", zones, 52.5200, 13.4049, "work"},
+		{"only larger zone", zones, 52.5250, 13.4049, "city"}, // ~556m north
+		{"outside all", zones, 48.1372, 11.5756, ""},
+		{"no zones", nil, 52.5163, 13.3777, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := zoneOf(tt.zones, tt.lat, tt.lon); got != tt.want {
+				t.Errorf("zoneOf = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDistance(t *testing.T) {
+	// Berlin to Munich is about 504km
+	if d := distance(52.5200, 13.4050, 48.1372, 11.5756); math.Abs(d-504e3) > 2e3 {
+		t.Errorf("distance = %.0fm, want about 504km", d)
+	}
+	if d := distance(52.5, 13.4, 52.5, 13.4); d != 0 {
+		t.Errorf("distance to itself = %g", d)
+	}
+}
+
+func TestBearing(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{"north", 52, 13, 52.01, 13, 0},
+		{"east", 0, 13, 0, 13.01, 90},
+		{"south", 52, 13, 51.99, 13, 180},
+		{"west", 0, 13, 0, 12.99, 270},
+		{"north east", 0, 0, 0.01, 0.01, 45},
+		{"across the date line", 0, 179.99, 0, -179.99, 90},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := bearing(tt.lat1, tt.lon1, tt.lat2, tt.lon2)
+			if math.Abs(got-tt.want) > 0.1 || got < 0 || got >= 360 {
+				t.Errorf("bearing = %g, want %g", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestZoneRedacted(t *testing.T) {
+	cfg := Config{Zones: []Zone{{Name: "home", Latitude: 52.5163, Longitude: 13.3777, Radius: 100}}}
+	for _, format := range []string{"%v", "%+v", "%#v"} {
+		if s := fmt.Sprintf(format, cfg); strings.Contains(s, "52.5163") || strings.Contains(s, "13.3777") {
+			t.Errorf("%s prints the zone coordinates: %s", format, s)
+		}
+	}
+}
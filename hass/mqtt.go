@@ -1,27 +1,83 @@
 package hass
 
 import (
-	"bytes"
-	"encoding/json"
-	"log"
-	"os"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/aeytom/silence-data/silence"
+	"github.com/aeytom/silence-data/logging"
+	"github.com/aeytom/silence-data/metrics"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
 const (
 	DiscoveryPrefix = "homeassistant"
+
+	// DiscoveryDevice publishes one discovery config per device,
+	// DiscoveryEntity one per entity for older consumers
+	DiscoveryDevice = "device"
+	DiscoveryEntity = "entity"
+
+	connectRetryInterval = 10 * time.Second
+	// reloadConnectTimeout bounds the connect to a changed broker, so a bad
+	// configuration cannot block the caller
+	reloadConnectTimeout = 30 * time.Second
+	maxReconnectInterval = time.Minute
+)
+
+var brokerSchemes = []string{"tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss"}
+
+var (
+	logger = slog.Default()
+
+	publishFailures = metrics.NewCounter("silence_mqtt_publish_failures_total",
+		"Failed MQTT publish operations")
+	reconnects = metrics.NewCounter("silence_mqtt_reconnects_total",
+		"Reconnects to the MQTT broker")
 )
 
 type Config struct {
-	MqttServer      string `yaml:"mqtt_server,omitempty" json:"mqtt_server,omitempty"`
-	MqttClientId    string `yaml:"mqtt_client_id,omitempty" json:"mqtt_client_id,omitempty"`
-	MqttUser        string `yaml:"mqtt_user,omitempty" json:"mqtt_user,omitempty"`
-	MqttPassword    string `yaml:"mqtt_password,omitempty" json:"mqtt_password,omitempty"`
-	DiscoveryPrefix string `yaml:"discovery_prefix,omitempty" json:"discovery_prefix,omitempty"`
+	MqttServer      string         `yaml:"mqtt_server,omitempty" json:"mqtt_server,omitempty"`
+	MqttClientId    string         `yaml:"mqtt_client_id,omitempty" json:"mqtt_client_id,omitempty"`
+	MqttUser        string         `yaml:"mqtt_user,omitempty" json:"mqtt_user,omitempty"`
+	MqttPassword    logging.Secret `yaml:"mqtt_password,omitempty" json:"mqtt_password,omitempty"`
+	DiscoveryPrefix string         `yaml:"discovery_prefix,omitempty" json:"discovery_prefix,omitempty"`
+	DiscoveryMode   string         `yaml:"discovery_mode,omitempty" json:"discovery_mode,omitempty" enum:"device,entity"`
+	ProtocolVersion uint           `yaml:"protocol_version,omitempty" json:"protocol_version,omitempty"`
+	Tls             TLSConfig      `yaml:"tls,omitempty" json:"tls,omitempty"`
+
+	BaseTopic         string `yaml:"base_topic,omitempty" json:"base_topic,omitempty"`
+	AvailabilityTopic string `yaml:"availability_topic,omitempty" json:"availability_topic,omitempty"`
+	LocationTopic     string `yaml:"location_topic,omitempty" json:"location_topic,omitempty"`
+	StateTopic        string `yaml:"state_topic,omitempty" json:"state_topic,omitempty"`
+	EventTopic        string `yaml:"event_topic,omitempty" json:"event_topic,omitempty"`
+	TripsTopic        string `yaml:"trips_topic,omitempty" json:"trips_topic,omitempty"`
+	Qos               byte   `yaml:"qos,omitempty" json:"qos,omitempty"`
+	StateQos          *byte  `yaml:"state_qos,omitempty" json:"state_qos,omitempty"`
+	EventQos          *byte  `yaml:"event_qos,omitempty" json:"event_qos,omitempty"`
+	RetainState       bool   `yaml:"retain_state,omitempty" json:"retain_state,omitempty"`
+
+	GpsAccuracy int16  `yaml:"gps_accuracy,omitempty" json:"gps_accuracy,omitempty"`
+	Zones       []Zone `yaml:"zones,omitempty" json:"zones,omitempty"`
+
+	StoreDir     string `yaml:"store_dir,omitempty" json:"store_dir,omitempty"`
+	CleanSession bool   `yaml:"clean_session,omitempty" json:"clean_session,omitempty"`
+
+	// tool marks the client of a command line tool running next to the
+	// daemon, which must not touch the bridge availability
+	tool bool
 }
 
+// Meter is a device announced to Home Assistant that publishes its values
 type Meter interface {
 	HassRegister(c *Client) *Handle
 	HassSendValue()
@@ -50,122 +106,410 @@ type HaDevice struct {
 	ModelId          string     `json:"model_id,omitempty"`
 	Name             string     `json:"name,omitempty"`
 	SwVersion        string     `json:"sw_version,omitempty"`
+	ViaDevice        string     `json:"via_device,omitempty"`
 }
 
 type DiscoveryPayload struct {
-	CommandTopic           string `json:"command_topic,omitempty"`
-	DeviceClass            string `json:"device_class,omitempty"`
-	JsonAttributesTemplate string `json:"json_attributes_template,omitempty"`
-	JsonAttributesTopic    string `json:"json_attributes_topic,omitempty"`
-	Name                   string `json:"name,omitempty"`
-	ObjectId               string `json:"object_id,omitempty"`
-	Platform               string `json:"platform,omitempty"`
-	StateClass             string `json:"state_class,omitempty"`
-	StateTopic             string `json:"state_topic,omitempty"`
-	SupportUrl             string `json:"support_url,omitempty"`
-	SwVersion              string `json:"sw_version,omitempty"`
-	UniqueId               string `json:"unique_id,omitempty"`
-	UnitOfMeasurement      string `json:"unit_of_measurement,omitempty"`
-	ValueTemplate          string `json:"value_template,omitempty"`
+	AutomationType         string   `json:"automation_type,omitempty"`
+	CommandTopic           string   `json:"command_topic,omitempty"`
+	DeviceClass            string   `json:"device_class,omitempty"`
+	EntityCategory         string   `json:"entity_category,omitempty"`
+	EventTypes             []string `json:"event_types,omitempty"`
+	Icon                   string   `json:"icon,omitempty"`
+	JsonAttributesTemplate string   `json:"json_attributes_template,omitempty"`
+	JsonAttributesTopic    string   `json:"json_attributes_topic,omitempty"`
+	Max                    float64  `json:"max,omitempty"`
+	Min                    float64  `json:"min,omitempty"`
+	Mode                   string   `json:"mode,omitempty"`
+	Name                   string   `json:"name,omitempty"`
+	ObjectId               string   `json:"object_id,omitempty"`
+	SourceType             string   `json:"source_type,omitempty"`
+	Payload                string   `json:"payload,omitempty"`
+	PayloadOff             string   `json:"payload_off,omitempty"`
+	PayloadOn              string   `json:"payload_on,omitempty"`
+	PayloadPress           string   `json:"payload_press,omitempty"`
+	PayloadReset           string   `json:"payload_reset,omitempty"`
+	Platform               string   `json:"platform,omitempty"`
+	Step                   float64  `json:"step,omitempty"`
+	StateClass             string   `json:"state_class,omitempty"`
+	StateTopic             string   `json:"state_topic,omitempty"`
+	Subtype                string   `json:"subtype,omitempty"`
+	SupportUrl             string   `json:"support_url,omitempty"`
+	SwVersion              string   `json:"sw_version,omitempty"`
+	Topic                  string   `json:"topic,omitempty"`
+	Type                   string   `json:"type,omitempty"`
+	UniqueId               string   `json:"unique_id,omitempty"`
+	UnitOfMeasurement      string   `json:"unit_of_measurement,omitempty"`
+	ValueTemplate          string   `json:"value_template,omitempty"`
 }
 
 type DeviceDiscovery struct {
-	Availability Availability                `json:"availability,omitempty"`
-	Components   map[string]DiscoveryPayload `json:"components,omitempty"`
-	Device       HaDevice                    `json:"device,omitempty"`
-	Encoding     string                      `json:"encoding,omitempty"`
-	Origin       Origin                      `json:"origin,omitempty"`
-	Qos          int16                       `json:"qos,omitempty"`
-	StateTopic   string                      `json:"state_topic,omitempty"`
+	Availability     []Availability              `json:"availability,omitempty"`
+	AvailabilityMode string                      `json:"availability_mode,omitempty"`
+	Components       map[string]DiscoveryPayload `json:"components,omitempty"`
+	Device           HaDevice                    `json:"device,omitempty"`
+	Encoding         string                      `json:"encoding,omitempty"`
+	Origin           Origin                      `json:"origin,omitempty"`
+	Qos              int16                       `json:"qos,omitempty"`
+	StateTopic       string                      `json:"state_topic,omitempty"`
 }
 
+// EntityDiscovery is the discovery config of a single entity, used in the
+// legacy entity discovery mode
 type EntityDiscovery struct {
-	Availability     Availability `json:"availability,omitempty"`
-	Device           HaDevice     `json:"device,omitempty"`
-	DiscoveryPayload `json:"discovery_payload,omitempty"`
+	Availability     []Availability `json:"availability,omitempty"`
+	AvailabilityMode string         `json:"availability_mode,omitempty"`
+	Device           HaDevice       `json:"device,omitempty"`
+	Origin           Origin         `json:"origin,omitempty"`
+	Qos              int16          `json:"qos,omitempty"`
+	DiscoveryPayload
 }
 
 type DeviceTrackerAttributes struct {
+	SourceType  string  `json:"source_type,omitempty"`
 	GpsAccuracy int16   `json:"gps_accuracy,omitempty"`
 	Latitude    float64 `json:"latitude"`
 	Longitude   float64 `json:"longitude"`
+	Altitude    int32   `json:"altitude"`
+	Speed       int32   `json:"speed"`
+	Course      float64 `json:"course"`
+	Time        string  `json:"time,omitempty"`
 	Zone        string  `json:"zone,omitempty"`
 }
 
 type Client struct {
 	Client          mqtt.Client
 	DiscoveryPrefix string
-	Scooters        []*silence.ScooterResp
+	Scooters        *Registry
+
+	mu   sync.RWMutex
+	cfg  Config
+	subs map[string]*subscription
+	sent map[string][]byte
+	// fixes holds the last location per scooter to derive the course
+	fixes map[string]DeviceTrackerAttributes
+
+	publishes chan publication
+	// pending counts the queued and in-flight messages; idle is signalled
+	// when it drops to zero
+	pending atomic.Int64
+	idle    chan struct{}
+
+	announced     map[string]Announced
+	announcedPath string
 }
 
+// Handle is a device registered by a Meter
 type Handle struct {
 	Mqtt   *Client
-	Object DiscoveryPayload
+	Object DeviceDiscovery
 }
 
-func Connect(cfg Config) *Client {
-	c := Client{}
-	opts := mqtt.NewClientOptions().AddBroker(cfg.MqttServer).SetClientID(cfg.MqttClientId)
-	opts.SetUsername(cfg.MqttUser)
-	opts.SetPassword(cfg.MqttPassword)
-	opts.SetAutoReconnect(true)
-	//
-	mqtt.ERROR = log.New(os.Stdout, "[ERROR] ", 0)
-	mqtt.CRITICAL = log.New(os.Stdout, "[CRIT] ", 0)
-	mqtt.WARN = log.New(os.Stdout, "[WARN]  ", 0)
-	mqtt.DEBUG = log.New(os.Stdout, "[DEBUG] ", 0)
-	//
-	c.Client = mqtt.NewClient(opts)
-	if token := c.Client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+// SetLogger sets the logger of the package and of the paho MQTT client
+func SetLogger(l *slog.Logger) {
+	logger = l
+	mqtt.ERROR = logging.Printer{Logger: l, Level: slog.LevelError}
+	mqtt.CRITICAL = logging.Printer{Logger: l, Level: slog.LevelError}
+	mqtt.WARN = logging.Printer{Logger: l, Level: slog.LevelWarn}
+	// the Printer drops debug messages unless log.level is debug, also
+	// after the level was reloaded
+	mqtt.DEBUG = logging.Printer{Logger: l, Level: slog.LevelDebug}
+}
+
+// Connect connects to the broker. It retries until the broker is reachable
+// and only fails on configuration errors, including a refused connection.
+func Connect(cfg Config) (*Client, error) {
+	cfg = cfg.withDefaults()
+	c := Client{
+		Scooters:  NewRegistry(),
+		subs:      map[string]*subscription{},
+		publishes: make(chan publication, publishQueueSize),
+		idle:      make(chan struct{}, 1),
+		sent:      map[string][]byte{},
+		fixes:     map[string]DeviceTrackerAttributes{},
+		announced: map[string]Announced{},
+		cfg:       cfg,
 	}
+	c.DiscoveryPrefix = cfg.DiscoveryPrefix
+	client, err := c.newClient(cfg, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := dial(client, cfg.MqttServer, time.Time{}); err != nil {
+		return nil, err
+	}
+	c.Client = client
+	c.startPublishers()
+	return &c, nil
+}
+
+// ConnectTool connects a command line tool. It uses its own client id and a
+// clean session without store, so it neither kicks the running daemon off
+// the broker nor shares its session, and leaves the bridge availability
+// alone.
+func ConnectTool(cfg Config) (*Client, error) {
+	return Connect(toolConfig(cfg))
+}
+
+func toolConfig(cfg Config) Config {
+	cfg.CleanSession = true
+	cfg.StoreDir = ""
+	cfg.tool = true
+	return cfg
+}
 
-	if cfg.DiscoveryPrefix == "" {
-		c.DiscoveryPrefix = DiscoveryPrefix
-	} else {
-		c.DiscoveryPrefix = cfg.DiscoveryPrefix
+// clientId returns the MQTT client id; MqttClientId also identifies the
+// bridge device, so a tool only changes the id it connects with
+func (cfg Config) clientId() string {
+	if cfg.tool && cfg.MqttClientId != "" {
+		return cfg.MqttClientId + "-cli"
 	}
+	return cfg.MqttClientId
+}
 
-	return &c
+// newClient creates a client; with retry, Connect keeps retrying in the
+// background until the broker accepts the connection
+func (c *Client) newClient(cfg Config, retry bool) (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions().AddBroker(cfg.MqttServer).SetClientID(cfg.clientId())
+	opts.SetUsername(cfg.MqttUser)
+	opts.SetPassword(string(cfg.MqttPassword))
+	opts.SetProtocolVersion(cfg.ProtocolVersion)
+	if isTLS(cfg.MqttServer) {
+		tc, err := cfg.Tls.config()
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		opts.SetTLSConfig(tc)
+	}
+	if cfg.StoreDir != "" {
+		opts.SetStore(mqtt.NewFileStore(cfg.StoreDir))
+	}
+	// a persistent session needs a stable client id
+	opts.SetCleanSession(cfg.CleanSession || cfg.MqttClientId == "")
+	opts.SetResumeSubs(true)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(maxReconnectInterval)
+	opts.SetConnectTimeout(connectRetryInterval)
+	opts.SetConnectRetry(retry)
+	opts.SetConnectRetryInterval(connectRetryInterval)
+	opts.SetConnectionAttemptHandler(func(broker *url.URL, tc *tls.Config) *tls.Config {
+		logger.Debug("connecting to MQTT broker", "broker", broker.Redacted())
+		return tc
+	})
+	if !cfg.tool {
+		opts.SetWill(cfg.bridgeTopic("availability"), "offline", 1, true)
+	}
+	opts.SetOnConnectHandler(c.onConnect)
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		logger.Warn("connection to MQTT broker lost", "server", cfg.MqttServer, "err", err)
+	})
+	opts.SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+		reconnects.Inc()
+	})
+	return mqtt.NewClient(opts), nil
 }
 
-func (c *Client) Subscribe(topic string, qos byte) chan mqtt.Message {
-	choke := make(chan mqtt.Message)
+// dial connects client. An unreachable broker is retried until deadline,
+// or forever if it is zero; a refused connection, e.g. for bad credentials,
+// is a configuration error and returned at once.
+func dial(client mqtt.Client, server string, deadline time.Time) error {
+	for {
+		t := client.Connect()
+		t.Wait()
+		err := t.Error()
+		switch {
+		case err == nil:
+			return nil
+		case refused(err):
+			return fmt.Errorf("broker %s refused the connection: %w", server, err)
+		case !deadline.IsZero() && time.Now().Add(connectRetryInterval).After(deadline):
+			return fmt.Errorf("no connection to %s: %w", server, err)
+		}
+		logger.Warn("waiting for MQTT broker", "server", server, "err", err)
+		time.Sleep(connectRetryInterval)
+	}
+}
 
-	msgHandler := func(client mqtt.Client, msg mqtt.Message) {
-		choke <- msg
+// refused reports whether the broker rejected the connection for a reason
+// which does not go away by retrying
+func refused(err error) bool {
+	for _, e := range []error{
+		packets.ErrorRefusedBadProtocolVersion,
+		packets.ErrorRefusedIDRejected,
+		packets.ErrorRefusedBadUsernameOrPassword,
+		packets.ErrorRefusedNotAuthorised,
+	} {
+		if errors.Is(err, e) {
+			return true
+		}
 	}
+	return false
+}
 
-	if token := c.Client.Subscribe(topic, qos, msgHandler); token.Wait() && token.Error() != nil {
-		log.Fatalln(token.Error())
+// onConnect announces the bridge and restores the subscriptions after
+// (re)connecting
+func (c *Client) onConnect(client mqtt.Client) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.cfg.tool {
+		client.Publish(c.cfg.bridgeTopic("availability"), 1, true, "online")
+	}
+	for topic, sub := range c.subs {
+		client.Subscribe(topic, sub.qos, sub.callback)
 	}
-	return choke
 }
 
-func (c *Client) Send(topic string, qos byte, retain bool, payload interface{}) {
-	switch p := payload.(type) {
-	case string:
-		c.sendBytes(topic, qos, retain, []byte(p))
-	case []byte:
-		c.sendBytes(topic, qos, retain, p)
-	case bytes.Buffer:
-		c.sendBytes(topic, qos, retain, p.Bytes())
+// Validate returns the configuration problems, each prefixed by the yaml key
+func (cfg Config) Validate() []error {
+	var errs []error
+	if cfg.MqttServer == "" {
+		errs = append(errs, errors.New("mqtt_server: required"))
+	} else if u, err := url.Parse(cfg.MqttServer); err != nil {
+		errs = append(errs, fmt.Errorf("mqtt_server: %w", err))
+	} else if !slices.Contains(brokerSchemes, u.Scheme) || u.Host == "" {
+		errs = append(errs, fmt.Errorf("mqtt_server: %q must be <scheme>://host:port with scheme one of %s",
+			cfg.MqttServer, strings.Join(brokerSchemes, ", ")))
+	}
+	if err := validateTopic(cfg.DiscoveryPrefix); err != nil {
+		errs = append(errs, fmt.Errorf("discovery_prefix: %w", err))
+	}
+	switch cfg.DiscoveryMode {
+	case "", DiscoveryDevice, DiscoveryEntity:
 	default:
-		if msg, err := json.Marshal(p); err == nil {
-			c.sendBytes(topic, qos, retain, msg)
-		} else {
-			mqtt.ERROR.Println(err)
+		errs = append(errs, fmt.Errorf("discovery_mode: must be %s or %s, got %q", DiscoveryDevice, DiscoveryEntity, cfg.DiscoveryMode))
+	}
+	if err := validateTopic(cfg.BaseTopic); err != nil {
+		errs = append(errs, fmt.Errorf("base_topic: %w", err))
+	}
+	for key, tmpl := range map[string]string{
+		"availability_topic": cfg.AvailabilityTopic,
+		"location_topic":     cfg.LocationTopic,
+		"state_topic":        cfg.StateTopic,
+		"event_topic":        cfg.EventTopic,
+		"trips_topic":        cfg.TripsTopic,
+	} {
+		if err := validateTemplate(tmpl); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
 		}
 	}
+	switch cfg.ProtocolVersion {
+	case 0, 3, 4:
+	case 5:
+		errs = append(errs, errors.New("protocol_version: MQTT v5 is not supported, use 3 (3.1) or 4 (3.1.1)"))
+	default:
+		errs = append(errs, fmt.Errorf("protocol_version: must be 3 or 4, got %d", cfg.ProtocolVersion))
+	}
+	for _, err := range cfg.Tls.Validate() {
+		errs = append(errs, fmt.Errorf("tls: %w", err))
+	}
+	if cfg.GpsAccuracy < 0 {
+		errs = append(errs, fmt.Errorf("gps_accuracy: must not be negative, got %d", cfg.GpsAccuracy))
+	}
+	for i, z := range cfg.Zones {
+		for _, err := range z.Validate() {
+			errs = append(errs, fmt.Errorf("zones[%d].%w", i, err))
+		}
+	}
+	for key, qos := range map[string]*byte{"qos": &cfg.Qos, "state_qos": cfg.StateQos, "event_qos": cfg.EventQos} {
+		if qos != nil && *qos > 2 {
+			errs = append(errs, fmt.Errorf("%s: must be 0, 1 or 2, got %d", key, *qos))
+		}
+	}
+	return errs
 }
 
-func (c *Client) sendBytes(topic string, qos byte, retain bool, msg []byte) {
-	mqtt.DEBUG.Printf("topic: %s message: %s", topic, msg)
-	t := c.Client.Publish(topic, qos, retain, msg)
-	go func() {
-		_ = t.Wait()
-		if t.Error() != nil {
-			mqtt.ERROR.Println(t.Error())
+// validateTopic checks a topic or topic prefix used for publishing
+func validateTopic(topic string) error {
+	switch {
+	case strings.ContainsAny(topic, "+#\x00"):
+		return fmt.Errorf("%q must not contain wildcards or NUL", topic)
+	case strings.HasPrefix(topic, "/") || strings.HasSuffix(topic, "/"):
+		return fmt.Errorf("%q must not start or end with /", topic)
+	}
+	return nil
+}
+
+// connection returns the part of the configuration that requires a reconnect
+func (cfg Config) connection() Config {
+	cfg.DiscoveryPrefix = ""
+	cfg.DiscoveryMode = ""
+	cfg.AvailabilityTopic = ""
+	cfg.LocationTopic = ""
+	cfg.StateTopic = ""
+	cfg.EventTopic = ""
+	cfg.TripsTopic = ""
+	cfg.Qos = 0
+	cfg.StateQos = nil
+	cfg.EventQos = nil
+	cfg.RetainState = false
+	cfg.GpsAccuracy = 0
+	cfg.Zones = nil
+	return cfg
+}
+
+// Apply switches to a changed configuration. The broker connection is only
+// renewed if connection settings changed; this is reported by the result.
+// If the changed broker is not reachable, the previous configuration is
+// restored and the error returned.
+func (c *Client) Apply(cfg Config) (bool, error) {
+	cfg = cfg.withDefaults()
+	c.mu.Lock()
+	old := c.cfg
+	c.cfg = cfg
+	c.DiscoveryPrefix = cfg.DiscoveryPrefix
+	c.mu.Unlock()
+	c.moveSubscription(old.statusTopic(), cfg.statusTopic())
+	c.moveSubscription(old.bridgeCommandTopic("+"), cfg.bridgeCommandTopic("+"))
+	if reflect.DeepEqual(old.connection(), cfg.connection()) {
+		return false, nil
+	}
+
+	logger.Info("reconnecting to MQTT broker", "server", cfg.MqttServer)
+	c.flush(time.Second)
+	c.mqtt().Disconnect(250)
+	client, err := c.newClient(cfg, false)
+	if err == nil {
+		err = dial(client, cfg.MqttServer, time.Now().Add(reloadConnectTimeout))
+	}
+	if err != nil {
+		c.mu.Lock()
+		c.cfg = old
+		c.DiscoveryPrefix = old.DiscoveryPrefix
+		c.mu.Unlock()
+		c.moveSubscription(cfg.statusTopic(), old.statusTopic())
+		c.moveSubscription(cfg.bridgeCommandTopic("+"), old.bridgeCommandTopic("+"))
+		// the previous broker is not waited for, the client keeps retrying
+		var rerr error
+		if client, rerr = c.newClient(old, true); rerr != nil {
+			logger.Error("reconnect failed", "err", rerr)
+			return false, err
 		}
-	}()
+		client.Connect()
+	}
+	c.mu.Lock()
+	c.Client = client
+	c.sent = map[string][]byte{}
+	c.mu.Unlock()
+	return true, err
+}
+
+func (c *Client) mqtt() mqtt.Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Client
+}
+
+// Reconnects returns the number of reconnects to the broker
+func (c *Client) Reconnects() int {
+	return int(reconnects.Value())
+}
+
+// IsConnected reports whether the broker connection is up
+func (c *Client) IsConnected() bool {
+	return c.mqtt().IsConnectionOpen()
+}
+
+// StatusTopic returns the topic Home Assistant announces its status on
+func (c *Client) StatusTopic() string {
+	return c.config().statusTopic()
 }
@@ -1,29 +1,39 @@
 package hass
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"slices"
+	"time"
 
+	"github.com/aeytom/silence-data/events"
 	"github.com/aeytom/silence-data/silence"
 )
 
-const (
-	AvailabilityTemplate = "silence/%s/availability"
-	LocationTemplate     = "silence/%s/location"
-	StateTemplate        = "silence/%s/scooter/state"
-)
+// SendDiscovery publishes the discovery config of a scooter
+func (c *Client) SendDiscovery(scooter silence.ScooterResp) {
+	c.publishScooter(scooter, false)
+}
 
-func RegisterScooter(c *Client, scooter silence.ScooterResp) {
-	c.SendDiscovery(scooter)
-	c.SendAvailability(scooter, true)
-	c.Scooters = append(c.Scooters, &scooter)
+// UpdateDiscovery publishes the discovery config of a scooter only if it
+// differs from the last one sent
+func (c *Client) UpdateDiscovery(scooter silence.ScooterResp) {
+	(&ScooterMeter{Scooter: scooter}).HassRegister(c)
 }
 
-func (c *Client) SendDiscovery(scooter silence.ScooterResp) {
+// deviceDiscovery returns the device discovery of a scooter
+func (c *Client) deviceDiscovery(scooter silence.ScooterResp) DeviceDiscovery {
+	cfg := c.config()
+	topics := c.scooterTopics(scooter)
 	dev := DeviceDiscovery{
-		StateTopic: fmt.Sprintf(StateTemplate, scooter.Id),
-		Availability: Availability{
-			Topic: fmt.Sprintf(AvailabilityTemplate, scooter.Id),
+		StateTopic: topics.State,
+		Availability: []Availability{
+			cfg.bridgeAvailability(),
+			{Topic: topics.Availability},
 		},
+		AvailabilityMode: "all",
+		Qos:              int16(cfg.Qos),
 		Device: HaDevice{
 			ConfigurationUrl: "",
 			Connections: [][]string{
@@ -36,127 +46,138 @@ func (c *Client) SendDiscovery(scooter silence.ScooterResp) {
 			ModelId:      "",
 			Name:         scooter.Name,
 			SwVersion:    scooter.TrackingDevice.FirmwareVersion,
+			ViaDevice:    c.BridgeId(),
 		},
 		Origin: Origin{
 			Name:      scooter.Name,
 			SwVersion: scooter.Revision,
 		},
 		Components: map[string]DiscoveryPayload{
-			"LastReportTime": {
-				Platform:      "sensor",
-				DeviceClass:   "timestamp",
-				Name:          "LastReportTime",
-				UniqueId:      scooter.Id + "-LastReportTime",
-				ValueTemplate: "{{ value_json.lastReportTime }}",
-			},
-			"LastLocationTime": {
-				Platform:      "sensor",
-				DeviceClass:   "timestamp",
-				Name:          "LastLocationTime",
-				UniqueId:      scooter.Id + "-LastLocationTime",
-				ValueTemplate: "{{ value_json.lastLocation.time }}",
-			},
-			"LastConnectionTime": {
-				Platform:      "sensor",
-				DeviceClass:   "timestamp",
-				Name:          "LastConnectionTime",
-				UniqueId:      scooter.Id + "-LastConnectionTime",
-				ValueTemplate: "{{ value_json.lastConnection }}",
-			},
-			"BatterySoc": {
-				Platform:          "sensor",
-				DeviceClass:       "battery",
-				Name:              "BatterySoc",
-				StateClass:        "measurement",
-				UnitOfMeasurement: "%",
-				UniqueId:          scooter.Id + "-BatterySoc",
-				ValueTemplate:     "{{ value_json.batterySoc }}",
-			},
-			"BatteryTemperature": {
-				Platform:          "sensor",
-				DeviceClass:       "temperature",
-				Name:              "BatteryTemperature",
-				StateClass:        "measurement",
-				UnitOfMeasurement: "°C",
-				UniqueId:          scooter.Id + "-BatteryTemperature",
-				ValueTemplate:     "{{ value_json.batteryTemperature }}",
-			},
-			"MotorTemperature": {
-				Platform:          "sensor",
-				DeviceClass:       "temperature",
-				Name:              "MotorTemperature",
-				StateClass:        "measurement",
-				UnitOfMeasurement: "°C",
-				UniqueId:          scooter.Id + "-MotorTemperature",
-				ValueTemplate:     "{{ value_json.motorTemperature }}",
-			},
-			"InverterTemperature": {
-				Platform:          "sensor",
-				DeviceClass:       "temperature",
-				Name:              "InverterTemperature",
-				StateClass:        "measurement",
-				UnitOfMeasurement: "°C",
-				UniqueId:          scooter.Id + "-InverterTemperature",
-				ValueTemplate:     "{{ value_json.inverterTemperature }}",
-			},
-			"Odometer": {
-				Platform:          "sensor",
-				DeviceClass:       "distance",
-				Name:              "Odometer",
-				StateClass:        "total_increasing",
-				UnitOfMeasurement: "km",
-				UniqueId:          scooter.Id + "-Odometer",
-				ValueTemplate:     "{{ value_json.odometer }}",
-			},
-			"Range": {
-				Platform:          "sensor",
-				DeviceClass:       "distance",
-				Name:              "Range",
-				StateClass:        "measurement",
-				UnitOfMeasurement: "km",
-				UniqueId:          scooter.Id + "-Range",
-				ValueTemplate:     "{{ value_json.range }}",
-			},
-			"Velocity": {
-				Platform:          "sensor",
-				DeviceClass:       "speed",
-				Name:              "Velocity",
-				StateClass:        "measurement",
-				UnitOfMeasurement: "km/h",
-				UniqueId:          scooter.Id + "-Velocity",
-				ValueTemplate:     "{{ value_json.velocity }}",
+			"FirmwareUpdate": {
+				Platform:       "update",
+				DeviceClass:    "firmware",
+				Name:           "Firmware",
+				EntityCategory: "diagnostic",
+				UniqueId:       scooter.Id + "-FirmwareUpdate",
+				// the latest version is unknown, it is reported as installed
+				ValueTemplate: fmt.Sprintf("{{ {'installed_version': value_json.%[1]s, "+
+					"'latest_version': value_json.%[1]s, "+
+					"'release_summary': 'Released ' ~ (value_json.%[2]s | default('unknown', true))} | to_json }}",
+					scooterEntity("Firmware").StatePath(), scooterEntity("FirmwareReleased").StatePath()),
 			},
+			// an own state topic, the device state topic would be taken
+			// as location name; outside the configured zones the state is
+			// reset and Home Assistant derives the zone from the position
 			"LastLocation": {
 				Platform:            "device_tracker",
 				Name:                "LastLocation",
-				JsonAttributesTopic: fmt.Sprintf(LocationTemplate, scooter.Id),
+				SourceType:          "gps",
+				StateTopic:          topics.Location,
+				ValueTemplate:       "{{ value_json.zone | default('None', true) }}",
+				PayloadReset:        "None",
+				JsonAttributesTopic: topics.Location,
 				UniqueId:            scooter.Id + "-LastLocation",
 			},
 		},
 	}
+	for _, e := range ScooterEntities {
+		if e.Platform != "" {
+			dev.Components[e.Key] = e.Discovery(scooter.Id)
+		}
+	}
+	addEventComponents(dev.Components, scooter.Id, topics.Event)
+	addTripComponents(dev.Components, scooter.Id, topics.Trips)
+	return dev
+}
 
-	topic := fmt.Sprintf("%s/%s/%s/config", c.DiscoveryPrefix, "device", scooter.Id)
-	c.Send(topic, 0, true, dev)
+// publishScooter publishes the discovery of a scooter, if onlyChanged only
+// if it differs from the last one sent
+func (c *Client) publishScooter(scooter silence.ScooterResp, onlyChanged bool) DeviceDiscovery {
+	dev := c.deviceDiscovery(scooter)
+	topics := c.scooterTopics(scooter)
+	c.publishDevice(scooter.Id, scooter.Name, dev, onlyChanged,
+		topics.Availability, topics.State, topics.Location, topics.Trips)
+	return dev
 }
 
-func (c *Client) Disconnect() {
-	for _, scooter := range c.Scooters {
-		c.SendAvailability(*scooter, false)
+// publishDevice publishes the discovery of a device in the configured
+// discovery mode and records its retained topics. Configs of the other mode
+// are cleared by announce.
+func (c *Client) publishDevice(id string, name string, dev DeviceDiscovery, onlyChanged bool, retained ...string) {
+	cfg := c.config()
+	configs := map[string]any{}
+	if cfg.DiscoveryMode == DiscoveryEntity {
+		for key, comp := range dev.Components {
+			topic := fmt.Sprintf("%s/%s/%s_%s/config", cfg.DiscoveryPrefix, comp.Platform, id, key)
+			configs[topic] = entityDiscovery(dev, comp)
+		}
+	} else {
+		configs[fmt.Sprintf("%s/%s/%s/config", cfg.DiscoveryPrefix, "device", id)] = dev
+	}
+
+	topics := make([]string, 0, len(configs))
+	for topic := range configs {
+		topics = append(topics, topic)
 	}
-	c.Client.Disconnect(250)
+	slices.Sort(topics)
+	for _, topic := range topics {
+		if msg, err := json.Marshal(configs[topic]); err != nil {
+			logger.Error("marshal discovery", "id", id, "err", err)
+		} else if changed := c.discoveryChanged(topic, msg); changed || !onlyChanged {
+			c.Send(topic, cfg.Qos, true, msg)
+		}
+	}
+	c.announce(id, name, append(topics, retained...)...)
 }
 
-func SendStatus(c *Client, scooter silence.ScooterResp) {
-	c.SendAvailability(scooter, true)
-	c.Send(fmt.Sprintf(StateTemplate, scooter.Id), 0, false, scooter)
+// entityDiscovery converts a component of a device discovery into a
+// standalone entity discovery
+func entityDiscovery(dev DeviceDiscovery, comp DiscoveryPayload) EntityDiscovery {
+	comp.Platform = ""
+	if comp.StateTopic == "" && comp.Topic == "" && comp.ValueTemplate != "" {
+		comp.StateTopic = dev.StateTopic
+	}
+	return EntityDiscovery{
+		Availability:     dev.Availability,
+		AvailabilityMode: dev.AvailabilityMode,
+		Device:           dev.Device,
+		Origin:           dev.Origin,
+		Qos:              dev.Qos,
+		DiscoveryPayload: comp,
+	}
 }
 
-func SendLocation(c *Client, scooter silence.ScooterResp) {
-	ja := DeviceTrackerAttributes{
-		Longitude: scooter.LastLocation.Longitude,
-		Latitude:  scooter.LastLocation.Latitude,
+// discoveryChanged records msg as the last discovery payload of topic and
+// reports whether it differs from the previous one
+func (c *Client) discoveryChanged(topic string, msg []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if bytes.Equal(c.sent[topic], msg) {
+		return false
+	}
+	c.sent[topic] = msg
+	return true
+}
+
+func (c *Client) Disconnect() {
+	for _, scooter := range c.Scooters.All() {
+		c.SendAvailability(scooter, false)
 	}
-	c.Send(fmt.Sprintf(LocationTemplate, scooter.Id), 0, false, ja)
+	c.Send(c.config().bridgeTopic("availability"), 1, true, "offline")
+	c.flush(5 * time.Second)
+	c.mqtt().Disconnect(250)
+}
+
+// Close disconnects from the broker without announcing the bridge offline
+func (c *Client) Close() {
+	c.flush(5 * time.Second)
+	c.mqtt().Disconnect(250)
+}
+
+func SendStatus(c *Client, scooter silence.ScooterResp) {
+	cfg := c.config()
+	c.SendAvailability(scooter, true)
+	c.Send(c.scooterTopics(scooter).State, cfg.stateQos(), cfg.RetainState, scooter)
 }
 
 func (c *Client) SendAvailability(scooter silence.ScooterResp, available bool) {
@@ -164,5 +185,13 @@ func (c *Client) SendAvailability(scooter silence.ScooterResp, available bool) {
 	if available {
 		pl = "online"
 	}
-	c.Send(fmt.Sprintf(AvailabilityTemplate, scooter.Id), 0, !available, pl)
+	c.Send(c.scooterTopics(scooter).Availability, c.config().Qos, true, pl)
+}
+
+func (c *Client) SendEvent(ev events.Event) {
+	scooter, ok := c.Scooters.Get(ev.ScooterId)
+	if !ok {
+		scooter = silence.ScooterResp{Id: ev.ScooterId, Name: ev.Name}
+	}
+	c.Send(c.scooterTopics(scooter).Event, c.config().eventQos(), false, ev)
 }
@@ -0,0 +1,94 @@
+package hass
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aeytom/silence-data/silence"
+)
+
+// Registry holds the latest snapshot of each scooter, keyed by id. It is
+// safe for concurrent use.
+type Registry struct {
+	mu       sync.RWMutex
+	scooters map[string]silence.ScooterResp
+}
+
+func NewRegistry() *Registry {
+	return &Registry{scooters: map[string]silence.ScooterResp{}}
+}
+
+// Put adds or updates a scooter and reports whether it was added
+func (r *Registry) Put(scooter silence.ScooterResp) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.scooters[scooter.Id]
+	r.scooters[scooter.Id] = scooter
+	return !ok
+}
+
+// Get returns the latest snapshot of a scooter
+func (r *Registry) Get(id string) (silence.ScooterResp, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.scooters[id]
+	return s, ok
+}
+
+// Remove removes a scooter and reports whether it was registered
+func (r *Registry) Remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.scooters[id]
+	delete(r.scooters, id)
+	return ok
+}
+
+// All returns the snapshots of all scooters ordered by id
+func (r *Registry) All() []silence.ScooterResp {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	all := make([]silence.ScooterResp, 0, len(r.scooters))
+	for _, s := range r.scooters {
+		all = append(all, s)
+	}
+	slices.SortFunc(all, func(a, b silence.ScooterResp) int { return strings.Compare(a.Id, b.Id) })
+	return all
+}
+
+// Len returns the number of registered scooters
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.scooters)
+}
+
+// Register adds or updates a scooter. New scooters are announced to Home
+// Assistant, the discovery of known ones is re-sent if it changed.
+func (c *Client) Register(scooter silence.ScooterResp) {
+	added := c.Scooters.Put(scooter)
+	(&ScooterMeter{Scooter: scooter}).HassRegister(c)
+	if added {
+		c.SendAvailability(scooter, true)
+	}
+}
+
+// Remove removes a scooter from the registry and from Home Assistant
+func (c *Client) Remove(id string) {
+	c.Scooters.Remove(id)
+	c.Forget(id)
+}
+
+// Announce re-sends the discovery, availability, state and location of all
+// registered scooters, e.g. after Home Assistant restarted
+func (c *Client) Announce() {
+	c.mu.Lock()
+	c.sent = map[string][]byte{}
+	c.mu.Unlock()
+	for _, s := range c.Scooters.All() {
+		m := &ScooterMeter{Scooter: s}
+		m.HassRegister(c)
+		m.HassSendValue()
+	}
+}
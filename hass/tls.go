@@ -0,0 +1,69 @@
+package hass
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+)
+
+// TLSConfig configures the TLS connection to brokers with the schemes ssl,
+// tls, mqtts and wss
+type TLSConfig struct {
+	CaFile     string `yaml:"ca_file,omitempty" json:"ca_file,omitempty"`
+	CertFile   string `yaml:"cert_file,omitempty" json:"cert_file,omitempty"`
+	KeyFile    string `yaml:"key_file,omitempty" json:"key_file,omitempty"`
+	ServerName string `yaml:"server_name,omitempty" json:"server_name,omitempty"`
+	Insecure   bool   `yaml:"insecure,omitempty" json:"insecure,omitempty"`
+}
+
+var tlsSchemes = []string{"ssl", "tls", "mqtts", "wss"}
+
+// isTLS reports whether the broker url requires TLS
+func isTLS(server string) bool {
+	u, err := url.Parse(server)
+	return err == nil && slices.Contains(tlsSchemes, u.Scheme)
+}
+
+// Validate returns the TLS configuration problems
+func (t TLSConfig) Validate() []error {
+	var errs []error
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, errors.New("cert_file and key_file must be set together"))
+	}
+	if _, err := t.config(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// config loads the CA bundle and the client certificate; the system roots
+// are used without ca_file
+func (t TLSConfig) config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.Insecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if t.CaFile != "" {
+		pem, err := os.ReadFile(t.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file: no PEM certificates in %s", t.CaFile)
+		}
+	}
+	if t.CertFile != "" && t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cert_file/key_file: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,137 @@
+package hass
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aeytom/silence-data/silence"
+)
+
+// Default topic layout. Templates may use the placeholders {base}, {id},
+// {name} (lower case, non-alphanumerics replaced by _) and {imei}.
+const (
+	DefaultBaseTopic         = "silence"
+	DefaultAvailabilityTopic = "{base}/{id}/availability"
+	DefaultLocationTopic     = "{base}/{id}/location"
+	DefaultStateTopic        = "{base}/{id}/scooter/state"
+	DefaultEventTopic        = "{base}/{id}/event"
+	DefaultTripsTopic        = "{base}/{id}/trips"
+)
+
+var nameSanitizer = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// withDefaults fills the unset topic layout settings
+func (cfg Config) withDefaults() Config {
+	if cfg.DiscoveryPrefix == "" {
+		cfg.DiscoveryPrefix = DiscoveryPrefix
+	}
+	if cfg.DiscoveryMode == "" {
+		cfg.DiscoveryMode = DiscoveryDevice
+	}
+	if cfg.GpsAccuracy == 0 {
+		cfg.GpsAccuracy = DefaultGpsAccuracy
+	}
+	if cfg.BaseTopic == "" {
+		cfg.BaseTopic = DefaultBaseTopic
+	}
+	if cfg.AvailabilityTopic == "" {
+		cfg.AvailabilityTopic = DefaultAvailabilityTopic
+	}
+	if cfg.LocationTopic == "" {
+		cfg.LocationTopic = DefaultLocationTopic
+	}
+	if cfg.StateTopic == "" {
+		cfg.StateTopic = DefaultStateTopic
+	}
+	if cfg.EventTopic == "" {
+		cfg.EventTopic = DefaultEventTopic
+	}
+	if cfg.TripsTopic == "" {
+		cfg.TripsTopic = DefaultTripsTopic
+	}
+	return cfg
+}
+
+// validateTemplate checks that a topic template is valid and unique per
+// scooter
+func validateTemplate(tmpl string) error {
+	if tmpl == "" {
+		return nil
+	}
+	if !strings.Contains(tmpl, "{id}") && !strings.Contains(tmpl, "{name}") && !strings.Contains(tmpl, "{imei}") {
+		return fmt.Errorf("%q must contain {id}, {name} or {imei}", tmpl)
+	}
+	if m := regexp.MustCompile(`\{[^}]*\}`).FindAllString(tmpl, -1); m != nil {
+		for _, p := range m {
+			switch p {
+			case "{base}", "{id}", "{name}", "{imei}":
+			default:
+				return fmt.Errorf("%q: unknown placeholder %s", tmpl, p)
+			}
+		}
+	}
+	return validateTopic(expandTopic(tmpl, "base", "id", "name", "imei"))
+}
+
+func expandTopic(tmpl string, base string, id string, name string, imei string) string {
+	name = nameSanitizer.ReplaceAllString(strings.ToLower(name), "_")
+	return strings.NewReplacer("{base}", base, "{id}", id, "{name}", name, "{imei}", imei).Replace(tmpl)
+}
+
+type scooterTopics struct {
+	Availability string
+	Location     string
+	State        string
+	Event        string
+	Trips        string
+}
+
+func (c *Client) scooterTopics(scooter silence.ScooterResp) scooterTopics {
+	cfg := c.config()
+	expand := func(tmpl string) string {
+		return expandTopic(tmpl, cfg.BaseTopic, scooter.Id, scooter.Name, scooter.Imei)
+	}
+	return scooterTopics{
+		Availability: expand(cfg.AvailabilityTopic),
+		Location:     expand(cfg.LocationTopic),
+		State:        expand(cfg.StateTopic),
+		Event:        expand(cfg.EventTopic),
+		Trips:        expand(cfg.TripsTopic),
+	}
+}
+
+// stateQos is the QoS of state and location messages, qos if unset
+func (cfg Config) stateQos() byte {
+	if cfg.StateQos != nil {
+		return *cfg.StateQos
+	}
+	return cfg.Qos
+}
+
+// eventQos is the QoS of event messages, 1 if unset
+func (cfg Config) eventQos() byte {
+	if cfg.EventQos != nil {
+		return *cfg.EventQos
+	}
+	return 1
+}
+
+func (cfg Config) bridgeTopic(name string) string {
+	return cfg.BaseTopic + "/bridge/" + name
+}
+
+func (cfg Config) bridgeCommandTopic(command string) string {
+	return cfg.bridgeTopic(command + "/set")
+}
+
+func (cfg Config) statusTopic() string {
+	return cfg.DiscoveryPrefix + "/status"
+}
+
+// config returns the configuration with defaults applied
+func (c *Client) config() Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cfg
+}
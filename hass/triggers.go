@@ -0,0 +1,33 @@
+package hass
+
+import (
+	"github.com/aeytom/silence-data/events"
+)
+
+// addEventComponents adds an event entity and a device trigger per event
+// type, both fed by the events published on topic
+func addEventComponents(components map[string]DiscoveryPayload, id string, topic string) {
+	types := make([]string, len(events.Types))
+	for i, t := range events.Types {
+		types[i] = string(t)
+	}
+	components["Event"] = DiscoveryPayload{
+		Platform:   "event",
+		Name:       "Event",
+		Icon:       "mdi:moped",
+		StateTopic: topic,
+		EventTypes: types,
+		UniqueId:   id + "-Event",
+	}
+	for _, t := range types {
+		components["Trigger_"+t] = DiscoveryPayload{
+			Platform:       "device_automation",
+			AutomationType: "trigger",
+			Topic:          topic,
+			Type:           t,
+			Subtype:        "scooter",
+			Payload:        t,
+			ValueTemplate:  "{{ value_json.event_type }}",
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package hass
+
+import (
+	"github.com/aeytom/silence-data/silence"
+)
+
+// TripStats is published to the trips topic of a scooter. The keys are the
+// state keys of TripEntities.
+type TripStats struct {
+	LastTripDistance    int32   `json:"last_trip_distance"`
+	LastTripDuration    float64 `json:"last_trip_duration"`
+	LastTripSpeedAvg    float32 `json:"last_trip_speed_avg"`
+	LastTripSpeedMax    float32 `json:"last_trip_speed_max"`
+	LastTripBatteryUsed int16   `json:"last_trip_battery_used"`
+	LastTripCo2Savings  float32 `json:"last_trip_co2_savings"`
+	LastTripFrom        string  `json:"last_trip_from"`
+	LastTripTo          string  `json:"last_trip_to"`
+	LastTripEnd         any     `json:"last_trip_end"`
+
+	TripDistanceToday int64 `json:"trip_distance_today"`
+	TripDistanceWeek  int64 `json:"trip_distance_week"`
+	TripDistanceMonth int64 `json:"trip_distance_month"`
+	TripsToday        int   `json:"trips_today"`
+	TripsWeek         int   `json:"trips_week"`
+	TripsMonth        int   `json:"trips_month"`
+}
+
+// TripEntities are the trip sensors of a scooter. Distances and CO2 savings
+// are reported in the units of the Silence API, meters and kilograms.
+var TripEntities = []Entity{
+	{Key: "LastTripDistance", Platform: "sensor", DeviceClass: "distance", StateClass: "measurement", Unit: "m"},
+	{Key: "LastTripDuration", Platform: "sensor", DeviceClass: "duration", StateClass: "measurement", Unit: "s"},
+	{Key: "LastTripSpeedAvg", Platform: "sensor", DeviceClass: "speed", StateClass: "measurement", Unit: "km/h"},
+	{Key: "LastTripSpeedMax", Platform: "sensor", DeviceClass: "speed", StateClass: "measurement", Unit: "km/h"},
+	{Key: "LastTripBatteryUsed", Platform: "sensor", StateClass: "measurement", Unit: "%", Icon: "mdi:battery-minus"},
+	{Key: "LastTripCo2Savings", Platform: "sensor", DeviceClass: "weight", StateClass: "measurement", Unit: "kg", Icon: "mdi:molecule-co2"},
+	{Key: "LastTripFrom", Platform: "sensor", Icon: "mdi:map-marker-outline"},
+	{Key: "LastTripTo", Platform: "sensor", Icon: "mdi:map-marker"},
+	{Key: "LastTripEnd", Platform: "sensor", DeviceClass: "timestamp"},
+	{Key: "TripDistanceToday", Platform: "sensor", DeviceClass: "distance", StateClass: "total_increasing", Unit: "m"},
+	{Key: "TripDistanceWeek", Platform: "sensor", DeviceClass: "distance", StateClass: "total_increasing", Unit: "m"},
+	{Key: "TripDistanceMonth", Platform: "sensor", DeviceClass: "distance", StateClass: "total_increasing", Unit: "m"},
+	{Key: "TripsToday", Platform: "sensor", StateClass: "total_increasing", Icon: "mdi:counter"},
+	{Key: "TripsWeek", Platform: "sensor", StateClass: "total_increasing", Icon: "mdi:counter"},
+	{Key: "TripsMonth", Platform: "sensor", StateClass: "total_increasing", Icon: "mdi:counter"},
+}
+
+// addTripComponents adds the trip sensors fed by the trip statistics
+// published on topic
+func addTripComponents(components map[string]DiscoveryPayload, id string, topic string) {
+	for _, e := range TripEntities {
+		d := e.Discovery(id)
+		d.StateTopic = topic
+		components[e.Key] = d
+	}
+}
+
+// SendTripStats publishes the trip statistics of a scooter; they are
+// retained, as they only change with new trips
+func (c *Client) SendTripStats(scooter silence.ScooterResp, st TripStats) {
+	if s, ok := c.Scooters.Get(scooter.Id); ok {
+		scooter = s
+	}
+	c.Send(c.scooterTopics(scooter).Trips, c.config().stateQos(), true, st)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aeytom/silence-data/hass"
+	"github.com/aeytom/silence-data/silence"
+)
+
+// Health tracks the state of the poll loop and the sinks for the /healthz and
+// /readyz endpoints
+type Health struct {
+	mu       sync.Mutex
+	started  time.Time
+	lastPoll time.Time
+	pollErr  error
+	paused   bool
+	interval time.Duration
+	si       *silence.Silence
+	ha       *hass.Client
+	ix       *InfluxWriter
+}
+
+type healthReport struct {
+	Status         string  `json:"status"`
+	Authenticated  bool    `json:"authenticated"`
+	LastPoll       string  `json:"last_poll,omitempty"`
+	LastPollAge    float64 `json:"last_poll_age_seconds"`
+	LastPollError  string  `json:"last_poll_error,omitempty"`
+	Paused         bool    `json:"paused,omitempty"`
+	MqttConnected  bool    `json:"mqtt_connected"`
+	InfluxBacklog  int     `json:"influx_backlog"`
+	InfluxCapacity int     `json:"influx_capacity"`
+}
+
+func NewHealth(interval time.Duration, si *silence.Silence, ha *hass.Client, ix *InfluxWriter) *Health {
+	return &Health{
+		started:  time.Now(),
+		interval: interval,
+		si:       si,
+		ha:       ha,
+		ix:       ix,
+	}
+}
+
+// SetInterval changes the expected poll interval
+func (h *Health) SetInterval(interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.interval = interval
+}
+
+// SetPaused records whether polling is paused; a paused poll loop is healthy
+func (h *Health) SetPaused(paused bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.paused = paused
+}
+
+// PollDone records the result of a poll
+func (h *Health) PollDone(t time.Time, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pollErr = err
+	if err == nil {
+		h.lastPoll = t
+	}
+}
+
+func (h *Health) report() healthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := healthReport{
+		Authenticated:  h.si.Authenticated(),
+		MqttConnected:  h.ha.IsConnected(),
+		InfluxBacklog:  h.ix.Backlog(),
+		InfluxCapacity: influxQueueSize,
+	}
+	since := h.started
+	if !h.lastPoll.IsZero() {
+		since = h.lastPoll
+		r.LastPoll = h.lastPoll.Format(time.RFC3339)
+	}
+	r.LastPollAge = time.Since(since).Seconds()
+	r.Paused = h.paused
+	if h.pollErr != nil {
+		r.LastPollError = h.pollErr.Error()
+	}
+	return r
+}
+
+// live reports whether the poll loop made progress within three intervals
+func (h *Health) live(r healthReport) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return r.Paused || r.LastPollAge < 3*h.interval.Seconds()
+}
+
+// ready additionally requires a successful poll and working sinks
+func (h *Health) ready(r healthReport) bool {
+	return h.live(r) && r.LastPoll != "" && r.Authenticated && r.MqttConnected &&
+		r.InfluxBacklog < r.InfluxCapacity*9/10
+}
+
+func (h *Health) ServeHealthz(w http.ResponseWriter, req *http.Request) {
+	r := h.report()
+	writeHealth(w, r, h.live(r))
+}
+
+func (h *Health) ServeReadyz(w http.ResponseWriter, req *http.Request) {
+	r := h.report()
+	writeHealth(w, r, h.ready(r))
+}
+
+func writeHealth(w http.ResponseWriter, r healthReport, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	r.Status = "ok"
+	if !ok {
+		r.Status = "fail"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(r)
+}
+
+// healthcheck queries /healthz of a running daemon and exits non-zero if it
+// is unhealthy or cannot be checked
+func healthcheck() {
+	if Conf.Http.Listen == "" {
+		fmt.Fprintln(os.Stderr, "http.listen is not configured, cannot check health")
+		os.Exit(1)
+	}
+	addr := Conf.Http.Listen
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + addr + "/healthz")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	var r healthReport
+	_ = json.NewDecoder(resp.Body).Decode(&r)
+	fmt.Printf("%s: %+v\n", resp.Status, r)
+	if resp.StatusCode != http.StatusOK {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aeytom/silence-data/events"
+	"github.com/aeytom/silence-data/hass"
+	"github.com/aeytom/silence-data/logging"
+	"github.com/aeytom/silence-data/metrics"
+	"github.com/aeytom/silence-data/silence"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	ilog "github.com/influxdata/influxdb-client-go/v2/log"
+)
+
+const (
+	influxQueueSize = 1000
+)
+
+var (
+	influxLogger = slog.Default()
+
+	influxWriteErrors = metrics.NewCounter("silence_influx_write_errors_total",
+		"Failed InfluxDB writes")
+	influxDropped = metrics.NewCounter("silence_influx_dropped_points_total",
+		"Points dropped because the InfluxDB write queue was full")
+)
+
+// InfluxWriter writes points from a bounded queue in the background, so a
+// slow or unreachable InfluxDB does not stall the poll loop
+type InfluxWriter struct {
+	mu       sync.RWMutex
+	client   influxdb2.Client
+	writeAPI api.WriteAPIBlocking
+	queue    chan *write.Point
+	done     chan struct{}
+}
+
+// NewInfluxWriter connects to the InfluxDB configured in Conf.Influx
+func NewInfluxWriter() *InfluxWriter {
+	w := &InfluxWriter{
+		queue: make(chan *write.Point, influxQueueSize),
+		done:  make(chan struct{}),
+	}
+	w.Reconfigure()
+	go w.run()
+	return w
+}
+
+// Reconfigure switches to the InfluxDB configured in Conf.Influx; queued
+// points are written to the new server
+func (w *InfluxWriter) Reconfigure() {
+	client := newInfluxClient()
+	w.mu.Lock()
+	old := w.client
+	w.client = client
+	w.writeAPI = client.WriteAPIBlocking(Conf.Influx.Org, Conf.Influx.Bucket)
+	w.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// WriteBlocking writes points immediately, bypassing the queue
+func (w *InfluxWriter) WriteBlocking(ctx context.Context, points ...*write.Point) error {
+	w.mu.RLock()
+	writeAPI := w.writeAPI
+	w.mu.RUnlock()
+	return writeAPI.WritePoint(ctx, points...)
+}
+
+func (w *InfluxWriter) run() {
+	defer close(w.done)
+	for point := range w.queue {
+		if err := w.WriteBlocking(context.Background(), point); err != nil {
+			influxWriteErrors.Inc()
+			influxLogger.Error("write failed", "err", err)
+		}
+	}
+}
+
+// Write queues points; points are dropped if the queue is full
+func (w *InfluxWriter) Write(points ...*write.Point) {
+	for _, p := range points {
+		select {
+		case w.queue <- p:
+		default:
+			influxDropped.Inc()
+		}
+	}
+}
+
+// Backlog returns the number of queued points
+func (w *InfluxWriter) Backlog() int {
+	return len(w.queue)
+}
+
+// Close writes the queued points and closes the client
+func (w *InfluxWriter) Close() {
+	close(w.queue)
+	<-w.done
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.client.Close()
+}
+
+func sendToInflux(w *InfluxWriter, scooter silence.ScooterResp) {
+	tags := map[string]string{
+		"id":       scooter.Id,
+		"model":    scooter.Model,
+		"revision": scooter.Revision,
+		"color":    scooter.Color,
+		"name":     scooter.Name,
+		"imei":     scooter.Imei,
+		"frameno":  scooter.FrameNo,
+		"firmware": scooter.TrackingDevice.FirmwareVersion,
+		"battery":  fmt.Sprint(scooter.BatteryId),
+	}
+	fields := hass.InfluxFields(scooter)
+	lt := scooter.LastConnection
+	if scooter.LastLocation.Time != "" {
+		lt = scooter.LastLocation.Time
+	} else if scooter.LastReportTime != "" {
+		lt = scooter.LastReportTime
+	}
+	if lrt, err := time.Parse(time.RFC3339, lt); err != nil {
+		influxLogger.Error("invalid location/report time", "scooter", scooter.Id, "time", lt, "err", err)
+	} else {
+		w.Write(influxdb2.NewPoint("scooter", tags, fields, lrt))
+	}
+}
+
+func sendEventToInflux(w *InfluxWriter, ev events.Event) {
+	tags := map[string]string{
+		"id":    ev.ScooterId,
+		"name":  ev.Name,
+		"event": string(ev.Type),
+	}
+	fields := map[string]interface{}{
+		"count": 1,
+	}
+	for k, v := range ev.Values {
+		fields[k] = v
+	}
+	w.Write(influxdb2.NewPoint("event", tags, fields, ev.Time))
+}
+
+func sendTripToInflux(w *InfluxWriter, scooter silence.ScooterResp, trip silence.Trip) error {
+	tags := map[string]string{
+		"id":   scooter.Id,
+		"name": scooter.Name,
+		"trip": trip.Id,
+	}
+	start, err := time.Parse(time.RFC3339, trip.StartDate)
+	if err != nil {
+		return err
+	}
+	end, err := time.Parse(time.RFC3339, trip.EndDate)
+	if err != nil {
+		end = start
+	}
+	fields := map[string]interface{}{
+		"distance":      trip.Distance,
+		"duration":      end.Sub(start).Seconds(),
+		"speed_max":     trip.SpeedMax,
+		"speed_avg":     trip.SpeedAvg,
+		"start_battery": trip.StartBattery,
+		"end_battery":   trip.EndBattery,
+		"battery_used":  trip.StartBattery - trip.EndBattery,
+		"co2_savings":   trip.Co2Savings,
+		"from":          trip.FromDescription,
+		"to":            trip.ToDescription,
+	}
+	points := []*write.Point{influxdb2.NewPoint("trip", tags, fields, end)}
+	for _, tp := range trip.Points {
+		ts, err := time.Parse(time.RFC3339, tp.Timestamp)
+		if err != nil {
+			continue
+		}
+		points = append(points, influxdb2.NewPoint("trip_point", tags, map[string]interface{}{
+			"lat": tp.Lat,
+			"lon": tp.Lon,
+		}, ts))
+	}
+	return w.WriteBlocking(context.Background(), points...)
+}
+
+func newInfluxClient() influxdb2.Client {
+	ilog.Log = &influxLog{}
+	opts := influxdb2.DefaultOptions().SetLogLevel(influxLogLevel())
+	return influxdb2.NewClientWithOptions(Conf.Influx.Url, string(Conf.Influx.Token), opts)
+}
+
+func influxLogLevel() uint {
+	switch l := logging.Level(); {
+	case l <= slog.LevelDebug:
+		return ilog.DebugLevel
+	case l <= slog.LevelWarn:
+		return ilog.WarningLevel
+	default:
+		return ilog.ErrorLevel
+	}
+}
+
+// influxLog routes the log messages of the influxdb2 client to influxLogger.
+// Its level follows log.level, so a reloaded level applies without a new
+// client.
+type influxLog struct{}
+
+func (l *influxLog) log(level uint, sl slog.Level, msg string) {
+	if level <= influxLogLevel() {
+		influxLogger.Log(context.Background(), sl, msg)
+	}
+}
+
+func (l *influxLog) Debugf(format string, v ...interface{}) {
+	l.log(ilog.DebugLevel, slog.LevelDebug, fmt.Sprintf(format, v...))
+}
+func (l *influxLog) Debug(msg string) { l.log(ilog.DebugLevel, slog.LevelDebug, msg) }
+func (l *influxLog) Infof(format string, v ...interface{}) {
+	l.log(ilog.InfoLevel, slog.LevelInfo, fmt.Sprintf(format, v...))
+}
+func (l *influxLog) Info(msg string) { l.log(ilog.InfoLevel, slog.LevelInfo, msg) }
+func (l *influxLog) Warnf(format string, v ...interface{}) {
+	l.log(ilog.WarningLevel, slog.LevelWarn, fmt.Sprintf(format, v...))
+}
+func (l *influxLog) Warn(msg string) { l.log(ilog.WarningLevel, slog.LevelWarn, msg) }
+func (l *influxLog) Errorf(format string, v ...interface{}) {
+	l.log(ilog.ErrorLevel, slog.LevelError, fmt.Sprintf(format, v...))
+}
+func (l *influxLog) Error(msg string)          { l.log(ilog.ErrorLevel, slog.LevelError, msg) }
+func (l *influxLog) SetLogLevel(logLevel uint) {}
+func (l *influxLog) LogLevel() uint            { return influxLogLevel() }
+func (l *influxLog) SetPrefix(prefix string)   {}
@@ -0,0 +1,175 @@
+// Package logging configures log/slog and provides types which keep secrets
+// and personal data out of the logs.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type Config struct {
+	Level  string `yaml:"level,omitempty" json:"level,omitempty" enum:"debug,info,warn,error"`
+	Format string `yaml:"format,omitempty" json:"format,omitempty" enum:"text,json"`
+}
+
+var (
+	level = new(slog.LevelVar)
+	// root is the handler behind the default logger; Setup swaps it, so
+	// loggers derived earlier follow a changed format
+	root atomic.Pointer[slog.Handler]
+)
+
+// Setup installs the default slog logger writing to stderr
+func Setup(cfg Config) error {
+	return SetupWriter(os.Stderr, cfg)
+}
+
+func SetupWriter(w io.Writer, cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	_ = SetLevel(cfg.Level)
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	if strings.ToLower(cfg.Format) == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	if root.Swap(&h) == nil {
+		slog.SetDefault(slog.New(switchHandler{}))
+	}
+	return nil
+}
+
+// switchHandler passes records to the current root handler; wrap applies
+// the attributes and groups of derived loggers
+type switchHandler struct {
+	wrap func(slog.Handler) slog.Handler
+}
+
+func (s switchHandler) apply(h slog.Handler) slog.Handler {
+	if s.wrap != nil {
+		h = s.wrap(h)
+	}
+	return h
+}
+
+func (s switchHandler) current() slog.Handler {
+	return s.apply(*root.Load())
+}
+
+func (s switchHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return s.current().Enabled(ctx, l)
+}
+
+func (s switchHandler) Handle(ctx context.Context, r slog.Record) error {
+	return s.current().Handle(ctx, r)
+}
+
+func (s switchHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return switchHandler{wrap: func(h slog.Handler) slog.Handler {
+		return s.apply(h).WithAttrs(attrs)
+	}}
+}
+
+func (s switchHandler) WithGroup(name string) slog.Handler {
+	return switchHandler{wrap: func(h slog.Handler) slog.Handler {
+		return s.apply(h).WithGroup(name)
+	}}
+}
+
+func (cfg Config) Validate() error {
+	if _, err := parseLevel(cfg.Level); err != nil {
+		return fmt.Errorf("level: %w", err)
+	}
+	switch strings.ToLower(cfg.Format) {
+	case "", "text", "json":
+		return nil
+	}
+	return fmt.Errorf("format: unknown log format %q, expected text or json", cfg.Format)
+}
+
+func parseLevel(l string) (slog.Level, error) {
+	var lv slog.Level
+	if l == "" {
+		return lv, nil
+	}
+	err := lv.UnmarshalText([]byte(l))
+	return lv, err
+}
+
+// SetLevel changes the level of the default logger; "" means info
+func SetLevel(l string) error {
+	lv, err := parseLevel(l)
+	if err != nil {
+		return err
+	}
+	level.Set(lv)
+	return nil
+}
+
+func Level() slog.Level {
+	return level.Level()
+}
+
+// Logger returns the default logger tagged with a subsystem
+func Logger(subsystem string) *slog.Logger {
+	return slog.Default().With("subsystem", subsystem)
+}
+
+// Secret is a string which is never printed or logged
+type Secret string
+
+func (s Secret) redacted() string {
+	if s == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+func (s Secret) String() string       { return s.redacted() }
+func (s Secret) GoString() string     { return fmt.Sprintf("%q", s.redacted()) }
+func (s Secret) LogValue() slog.Value { return slog.StringValue(s.redacted()) }
+
+// Personal is personal data like an email address or IMEI; only the first
+// character is printed or logged
+type Personal string
+
+func (p Personal) redacted() string {
+	if len(p) <= 1 {
+		return string(p)
+	}
+	return string(p[:1]) + "***"
+}
+
+func (p Personal) String() string       { return p.redacted() }
+func (p Personal) GoString() string     { return fmt.Sprintf("%q", p.redacted()) }
+func (p Personal) LogValue() slog.Value { return slog.StringValue(p.redacted()) }
+
+// Printer adapts a slog.Logger to Println/Printf style loggers like the ones
+// of the paho MQTT client. Messages below the current level are dropped
+// before they are formatted.
+type Printer struct {
+	Logger *slog.Logger
+	Level  slog.Level
+}
+
+func (p Printer) Println(v ...interface{}) {
+	if !p.Logger.Enabled(context.Background(), p.Level) {
+		return
+	}
+	p.Logger.Log(context.Background(), p.Level, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func (p Printer) Printf(format string, v ...interface{}) {
+	if !p.Logger.Enabled(context.Background(), p.Level) {
+		return
+	}
+	p.Logger.Log(context.Background(), p.Level, fmt.Sprintf(format, v...))
+}
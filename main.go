@@ -2,135 +2,505 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"flag"
+	"math/rand/v2"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/aeytom/silence-data/events"
 	"github.com/aeytom/silence-data/hass"
+	"github.com/aeytom/silence-data/logging"
+	"github.com/aeytom/silence-data/metrics"
 	"github.com/aeytom/silence-data/silence"
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
-	ilog "github.com/influxdata/influxdb-client-go/v2/log"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+const (
+	configWatchInterval = 5 * time.Second
+	hassAnnouncedFile   = "hass-announced.json"
+	purgeWait           = 2 * time.Second
+
+	// announceDelay is the maximum random delay before the entities are
+	// re-announced to a restarted Home Assistant
+	announceDelay = 5 * time.Second
+)
+
+// version is set at build time by -ldflags "-X main.version=…"
+var version = "dev"
+
 func main() {
 	ParseArgs()
 
-	ha := hass.Connect(Conf.HomeAssistant)
-	defer ha.Disconnect()
+	if flag.Arg(0) == "config" {
+		configCommand(flag.Args()[1:])
+		return
+	}
+	SetupConfig()
+
+	switch cmd := flag.Arg(0); cmd {
+	case "", "run":
+		run()
+	case "backfill":
+		backfill()
+	case "healthcheck":
+		healthcheck()
+	case "hass":
+		hassCommand(flag.Args()[1:])
+	default:
+		fatal("unknown command, expected run, backfill, healthcheck, hass or config", "command", cmd)
+	}
+}
+
+func login() *silence.Silence {
+	si := &silence.Silence{}
+	if err := si.Login(string(Conf.Silence.Email), string(Conf.Silence.Password)); err != nil {
+		fatal("login failed", "err", err)
+	}
+	return si
+}
+
+// backfill writes all trips not yet written to influx and exits
+func backfill() {
+	ix := NewInfluxWriter()
+	defer ix.Close()
+
+	si := login()
+	scooters, err := si.Details()
+	if err != nil {
+		fatal("fetch scooters", "err", err)
+	}
+	if err := NewTripSync(si, ix, nil).Sync(scooters); err != nil {
+		fatal("trip backfill", "err", err)
+	}
+}
+
+// hassCommand runs "hass purge [id…]", which removes the given devices, or
+// all devices announced by this bridge, from Home Assistant
+func hassCommand(args []string) {
+	if len(args) == 0 || args[0] != "purge" {
+		fatal("unknown hass command, expected purge")
+	}
+	ha, err := hass.ConnectTool(Conf.HomeAssistant)
+	if err != nil {
+		fatal("connect to MQTT broker", "err", err)
+	}
+	defer ha.Close()
+	if err := ha.LoadAnnounced(filepath.Join(Conf.StateDir, hassAnnouncedFile)); err != nil {
+		logger.Warn("load announced devices", "err", err)
+	}
+	recorded := ha.Announced()
+	found := ha.FindRetained(purgeWait)
+	logger.Info("retained discovery configs", "devices", len(found))
+	ids := args[1:]
+	if len(ids) == 0 {
+		ids = slices.Compact(slices.Sorted(slices.Values(append(recorded, found...))))
+	}
+	for _, id := range ids {
+		if !slices.Contains(recorded, id) && !slices.Contains(found, id) {
+			logger.Warn("device neither recorded nor found on the broker", "device", id)
+		}
+	}
+	ha.Purge(ids)
+	logger.Info("purged home assistant devices", "count", len(ids))
+}
+
+// daemon holds the components of the run command
+type daemon struct {
+	si        *silence.Silence
+	ha        *hass.Client
+	ix        *InfluxWriter
+	health    *Health
+	srv       *http.Server
+	bus       *events.Bus
+	outputs   *sync.WaitGroup
+	tripEnded chan string
+	detector  *events.Detector
+	firmware  *FirmwareHistory
+	ticker    *time.Ticker
+	hastatus  <-chan mqtt.Message
+	announce  <-chan time.Time
+	commands  chan hass.Command
+	stopTrips context.CancelFunc
+
+	started      time.Time
+	lastPoll     time.Time
+	pollInterval time.Duration
+	paused       bool
+}
+
+func run() {
+	d := &daemon{}
+	d.start()
+	defer d.stop()
 
-	ixclient := influxdb2.NewClient(Conf.Influx.Url, Conf.Influx.Token)
-	ixclient.Options().SetLogLevel(ilog.DebugLevel)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	changed := watchFile(*envPath, configWatchInterval)
+
+	for {
+		select {
+		case s := <-sigs:
+			if s == syscall.SIGHUP {
+				logger.Info("got SIGHUP, reloading configuration")
+				d.reload()
+				continue
+			}
+			logger.Info("got signal", "signal", s)
+			return
+		case <-changed:
+			logger.Info("configuration file changed, reloading", "path", *envPath)
+			d.reload()
+		case t := <-d.ticker.C:
+			if !d.paused {
+				d.poll(t)
+			}
+		case cmd := <-d.commands:
+			d.command(cmd)
+		case t := <-d.hastatus:
+			d.haStatus(string(t.Payload()))
+		case <-d.announce:
+			d.announce = nil
+			d.ha.Announce()
+			d.sendBridge()
+		}
+	}
+}
 
-	si := silence.Silence{}
-	if err := si.Login(Conf.Silence.Email, Conf.Silence.Password); err != nil {
-		log.Fatalln(err)
+// haStatus handles the birth and last will messages of Home Assistant. After
+// a restart the entities are re-announced with a random delay, so not every
+// integration floods Home Assistant at the same time.
+func (d *daemon) haStatus(status string) {
+	logger.Info("home assistant status", "status", status)
+	switch status {
+	case "online":
+		delay := time.Duration(rand.Int64N(int64(announceDelay)))
+		d.announce = time.After(delay)
+	case "offline":
+	default:
+		logger.Warn("unknown home assistant status", "status", status)
 	}
+}
 
+func (d *daemon) start() {
+	d.started = time.Now()
 	var err error
+	if d.ha, err = hass.Connect(Conf.HomeAssistant); err != nil {
+		fatal("connect to MQTT broker", "err", err)
+	}
+	if err := d.ha.LoadAnnounced(filepath.Join(Conf.StateDir, hassAnnouncedFile)); err != nil {
+		logger.Warn("load announced devices", "err", err)
+	}
+
+	d.ix = NewInfluxWriter()
+	metrics.NewGaugeFunc("silence_influx_queue_depth", "Points waiting to be written to InfluxDB",
+		func() float64 { return float64(d.ix.Backlog()) })
+	metrics.NewGaugeFunc("silence_mqtt_publish_queue_depth", "Messages waiting to be published to MQTT",
+		func() float64 { return float64(d.ha.PublishBacklog()) })
+
+	d.si = login()
+
+	d.health = NewHealth(Conf.PollInterval, d.si, d.ha, d.ix)
+	if d.srv, err = startHttpServer(d.health); err != nil {
+		fatal("http server", "err", err)
+	}
+
 	var profile silence.ProfileResponse
-	if profile, err = si.Me(); err != nil {
-		log.Fatalln(err)
+	if profile, err = d.si.Me(); err != nil {
+		fatal("fetch profile", "err", err)
 	} else {
-		log.Printf("%#v", profile)
+		logger.Info("logged in", "profile", profile)
 	}
 
-	// silence.TripsList(profile.Id, 100)
-	// panic("Schluss")
-
-	scooters, err := si.Details()
+	scooters, err := d.si.Details()
 	if err != nil {
-		log.Fatalln(err)
+		fatal("fetch scooters", "err", err)
 	} else {
 		for _, sc := range scooters {
-			hass.RegisterScooter(ha, sc)
+			d.ha.Register(sc)
 		}
+		d.ha.Prune(scooters)
 	}
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	ticker := time.NewTicker(30 * time.Second)
-	done := make(chan bool)
+	d.bus = events.NewBus()
+	d.detector = events.NewDetector(Conf.Events.ConnectionTimeout)
+	d.firmware = NewFirmwareHistory()
+	d.tripEnded = make(chan string, 16)
+	d.outputs = subscribeEvents(d.bus, d.ha, d.ix, d.tripEnded)
+	for _, sc := range scooters {
+		d.detector.Update(sc, time.Now())
+		for _, ev := range d.firmware.Observe(sc, time.Now()) {
+			d.bus.Publish(ev)
+		}
+	}
 
-	hastatus := ha.Subscribe(hass.DiscoveryPrefix+"/status", 0)
+	d.startTrips()
+	d.pollInterval = Conf.PollInterval
+	d.ticker = time.NewTicker(d.pollInterval)
+	if d.hastatus, err = d.ha.Subscribe(d.ha.StatusTopic(), 0); err != nil {
+		fatal("subscribe to home assistant status", "err", err)
+	}
+	if d.commands, err = d.ha.SubscribeCommands(); err != nil {
+		fatal("subscribe to bridge commands", "err", err)
+	}
+	d.sendBridge()
+}
 
-	go func() {
-		for {
-			select {
-			case <-done:
-				return
-			case s := <-sigs:
-				log.Print("Got signal: ", s)
-				done <- true
-				return
-			case t := <-ticker.C:
-				log.Println("Tick at", t)
-
-				scooters, err := si.Details()
-				if err != nil {
-					log.Fatalln(err)
-				}
-				log.Printf("%#v", scooters)
+// sendBridge publishes the bridge device and its state
+func (d *daemon) sendBridge() {
+	d.ha.SendBridgeDiscovery(version)
+	d.sendBridgeState()
+}
 
-				for _, scooter := range scooters {
-					hass.SendStatus(ha, scooter)
-					hass.SendLocation(ha, scooter)
-					sendToInflux(ixclient, scooter)
-				}
+// sendBridgeState publishes the bridge settings and diagnostics
+func (d *daemon) sendBridgeState() {
+	st := hass.BridgeState{
+		PollInterval:   d.pollInterval.Seconds(),
+		Paused:         d.paused,
+		Version:        version,
+		Started:        d.started.Format(time.RFC3339),
+		ApiErrors:      silence.ErrorCount(),
+		MqttReconnects: d.ha.Reconnects(),
+		InfluxBacklog:  d.ix.Backlog(),
+	}
+	if !d.lastPoll.IsZero() {
+		st.LastPoll = d.lastPoll.Format(time.RFC3339)
+	}
+	if exp := d.si.TokenExpiry(); !exp.IsZero() {
+		st.TokenExpiry = exp.Format(time.RFC3339)
+	}
+	d.ha.SendBridgeState(st)
+}
 
-			case t := <-hastatus:
-				log.Printf("Got homeasistent msg '%v' via topic '%s'\n", t.Payload(), t.Topic())
-				for _, s := range ha.Scooters {
-					ha.SendDiscovery(*s)
-				}
+// command handles a command sent from Home Assistant
+func (d *daemon) command(cmd hass.Command) {
+	logger.Info("home assistant command", "command", cmd.Name, "payload", cmd.Payload)
+	switch cmd.Name {
+	case hass.CommandPoll:
+		d.poll(time.Now())
+	case hass.CommandPollInterval:
+		secs, err := strconv.ParseFloat(cmd.Payload, 64)
+		if err != nil || secs < hass.MinPollInterval || secs > hass.MaxPollInterval {
+			logger.Warn("invalid poll interval", "payload", cmd.Payload)
+			break
+		}
+		d.setPollInterval(time.Duration(secs * float64(time.Second)))
+	case hass.CommandPause:
+		d.paused = cmd.Payload == "ON"
+		d.health.SetPaused(d.paused)
+	default:
+		logger.Warn("unknown command", "command", cmd.Name)
+	}
+	d.sendBridge()
+}
+
+func (d *daemon) setPollInterval(interval time.Duration) {
+	d.pollInterval = interval
+	d.ticker.Reset(interval)
+	d.health.SetInterval(interval)
+}
+
+func (d *daemon) stop() {
+	d.ticker.Stop()
+	d.stopTrips()
+	if d.srv != nil {
+		d.srv.Close()
+	}
+	d.bus.Close()
+	// the event outputs write to InfluxDB and MQTT until the bus is drained
+	d.outputs.Wait()
+	d.ix.Close()
+	d.ha.Disconnect()
+}
+
+// startTrips (re)starts the background trip sync
+func (d *daemon) startTrips() {
+	if d.stopTrips != nil {
+		d.stopTrips()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.stopTrips = cancel
+	if Conf.Trips.SyncInterval > 0 {
+		go NewTripSync(d.si, d.ix, d.ha).Run(ctx, Conf.Trips.SyncInterval, d.tripEnded)
+	}
+}
+
+func (d *daemon) poll(t time.Time) {
+	logger.Debug("tick", "time", t)
+	defer d.sendBridgeState()
+
+	scooters, err := d.si.Details()
+	d.health.PollDone(t, err)
+	if err != nil {
+		logger.Error("poll failed", "err", err)
+		return
+	}
+	lastPoll.Set(float64(t.Unix()))
+	d.lastPoll = t
+	for _, id := range d.ha.Prune(scooters) {
+		logger.Info("scooter disappeared", "scooter", id)
+		d.detector.Forget(id)
+		deleteMetrics(id)
+	}
+
+	for _, scooter := range scooters {
+		d.ha.Register(scooter)
+		hass.SendStatus(d.ha, scooter)
+		hass.SendLocation(d.ha, scooter)
+		sendToInflux(d.ix, scooter)
+		sendToMetrics(scooter)
+		logger.Debug("scooter", "scooter", scooter)
+		for _, ev := range d.detector.Update(scooter, t) {
+			d.bus.Publish(ev)
+		}
+		for _, ev := range d.firmware.Observe(scooter, t) {
+			d.bus.Publish(ev)
+		}
+	}
+}
+
+// reload loads and validates the configuration and applies the changes.
+// Only the affected components are reconfigured; an invalid configuration
+// is rejected and the current one is kept.
+func (d *daemon) reload() {
+	conf, err := LoadConfig()
+	if err != nil {
+		logger.Error("invalid configuration, keeping the current one", "err", err)
+		return
+	}
+	old := Conf
+	if reflect.DeepEqual(old, conf) {
+		logger.Info("configuration unchanged")
+		return
+	}
+	Conf = conf
+
+	if old.Log.Format != conf.Log.Format {
+		if err := logging.Setup(conf.Log); err != nil {
+			logger.Error("setup logging", "err", err)
+		}
+	} else if old.Log.Level != conf.Log.Level {
+		if err := logging.SetLevel(conf.Log.Level); err != nil {
+			logger.Error("set log level", "err", err)
+		}
+	}
+	if old.Silence != conf.Silence {
+		if err := d.si.Login(string(conf.Silence.Email), string(conf.Silence.Password)); err != nil {
+			logger.Error("login failed", "err", err)
+		}
+	}
+	if old.Influx != conf.Influx {
+		logger.Info("reconnecting to InfluxDB", "url", conf.Influx.Url)
+		d.ix.Reconfigure()
+	}
+	if old.PollInterval != conf.PollInterval {
+		d.setPollInterval(conf.PollInterval)
+		d.sendBridge()
+	}
+	if old.Events != conf.Events {
+		d.detector.ConnectionTimeout = conf.Events.ConnectionTimeout
+	}
+	if old.Http != conf.Http {
+		if srv, err := startHttpServer(d.health); err != nil {
+			logger.Error("http server, keeping the current one", "err", err)
+			Conf.Http = old.Http
+		} else {
+			if d.srv != nil {
+				d.srv.Close()
 			}
+			d.srv = srv
 		}
-	}()
+	}
+	if old.Trips != conf.Trips || old.StateDir != conf.StateDir {
+		d.startTrips()
+	}
+	if old.StateDir != conf.StateDir {
+		if err := d.ha.LoadAnnounced(filepath.Join(conf.StateDir, hassAnnouncedFile)); err != nil {
+			logger.Warn("load announced devices", "err", err)
+		}
+		d.firmware = NewFirmwareHistory()
+	}
+	if !reflect.DeepEqual(old.HomeAssistant, conf.HomeAssistant) {
+		reconnected, err := d.ha.Apply(conf.HomeAssistant)
+		if err != nil {
+			logger.Error("connect failed, keeping the previous broker settings", "err", err)
+			Conf.HomeAssistant = old.HomeAssistant
+		}
+		if reconnected {
+			d.ha.Announce()
+		} else {
+			for _, s := range d.ha.Scooters.All() {
+				d.ha.UpdateDiscovery(s)
+			}
+		}
+		d.sendBridge()
+	}
+	logger.Info("configuration reloaded")
+}
 
-	<-done
-	ticker.Stop()
-}
-
-func sendToInflux(ixclient influxdb2.Client, scooter silence.ScooterResp) {
-	writeAPI := ixclient.WriteAPIBlocking(Conf.Influx.Org, Conf.Influx.Bucket)
-	tags := map[string]string{
-		"id":       scooter.Id,
-		"model":    scooter.Model,
-		"revision": scooter.Revision,
-		"color":    scooter.Color,
-		"name":     scooter.Name,
-		"imei":     scooter.Imei,
-		"frameno":  scooter.FrameNo,
-		"firmware": scooter.TrackingDevice.FirmwareVersion,
-		"battery":  fmt.Sprint(scooter.BatteryId),
-	}
-	fields := map[string]interface{}{
-		"speed":    scooter.LastLocation.CurrentSpeed,
-		"bsoc":     scooter.BatterySoc,
-		"btemp":    scooter.BatteryTemperature,
-		"odo":      scooter.Odometer,
-		"mtemp":    scooter.MotorTemperature,
-		"itemp":    scooter.InverterTemperature,
-		"range":    scooter.Range,
-		"velocity": scooter.Velocity,
-		"lat":      scooter.LastLocation.Latitude,
-		"lon":      scooter.LastLocation.Longitude,
-	}
-	lt := scooter.LastConnection
-	if scooter.LastLocation.Time != "" {
-		lt = scooter.LastLocation.Time
-	} else if scooter.LastReportTime != "" {
-		lt = scooter.LastReportTime
-	}
-	log.Printf("last location/report time %#v", lt)
-	if lrt, err := time.Parse(time.RFC3339, lt); err != nil {
-		log.Fatalln(err)
-	} else {
-		point := influxdb2.NewPoint("scooter", tags, fields, lrt)
-		if err := writeAPI.WritePoint(context.Background(), point); err != nil {
-			log.Fatal(err)
+// watchFile signals changes of the modification time or size of path
+func watchFile(path string, every time.Duration) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	stat := func() (time.Time, int64) {
+		if fi, err := os.Stat(path); err == nil {
+			return fi.ModTime(), fi.Size()
+		}
+		return time.Time{}, -1
+	}
+	go func() {
+		mtime, size := stat()
+		for range time.Tick(every) {
+			m, s := stat()
+			if m.Equal(mtime) && s == size {
+				continue
+			}
+			mtime, size = m, s
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
 		}
+	}()
+	return ch
+}
+
+// subscribeEvents connects the event outputs to the event bus; the ids of
+// scooters with an ended trip are sent to tripEnded. The returned WaitGroup
+// is done when the bus is closed and all events are handled.
+func subscribeEvents(bus *events.Bus, ha *hass.Client, ix *InfluxWriter, tripEnded chan<- string) *sync.WaitGroup {
+	outputs := []func(events.Event){
+		func(ev events.Event) {
+			logger.Info("event", "event", ev)
+		},
+		ha.SendEvent,
+		func(ev events.Event) {
+			sendEventToInflux(ix, ev)
+		},
+		func(ev events.Event) {
+			if ev.Type == events.TripEnded {
+				select {
+				case tripEnded <- ev.ScooterId:
+				default:
+				}
+			}
+		},
+	}
+	wg := &sync.WaitGroup{}
+	for _, out := range outputs {
+		wg.Add(1)
+		go func(ch <-chan events.Event, out func(events.Event)) {
+			defer wg.Done()
+			for ev := range ch {
+				out(ev)
+			}
+		}(bus.Subscribe(16), out)
 	}
+	return wg
 }
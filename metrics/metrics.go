@@ -0,0 +1,268 @@
+// Package metrics implements a minimal Prometheus registry and the text
+// exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// Default is the registry the New* functions register with
+var Default = &Registry{}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.mu.Lock()
+	cs := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+	for _, c := range cs {
+		c.write(w)
+	}
+}
+
+func Handler() http.Handler {
+	return Default
+}
+
+// Vec is a gauge or counter with a set of label values per series
+type Vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newVec(typ string, name string, help string, labels []string) *Vec {
+	v := &Vec{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		values: map[string]float64{},
+	}
+	Default.register(v)
+	return v
+}
+
+func NewGauge(name string, help string, labels ...string) *Vec {
+	return newVec("gauge", name, help, labels)
+}
+
+func NewCounter(name string, help string, labels ...string) *Vec {
+	return newVec("counter", name, help, labels)
+}
+
+func (v *Vec) Set(val float64, lvs ...string) {
+	k := v.key(lvs)
+	v.mu.Lock()
+	v.values[k] = val
+	v.mu.Unlock()
+}
+
+func (v *Vec) Add(val float64, lvs ...string) {
+	k := v.key(lvs)
+	v.mu.Lock()
+	v.values[k] += val
+	v.mu.Unlock()
+}
+
+func (v *Vec) Inc(lvs ...string) {
+	v.Add(1, lvs...)
+}
+
+// Value returns the current value of a series
+func (v *Vec) Value(lvs ...string) float64 {
+	k := v.key(lvs)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.values[k]
+}
+
+// Sum returns the sum of all series
+func (v *Vec) Sum() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	sum := 0.0
+	for _, val := range v.values {
+		sum += val
+	}
+	return sum
+}
+
+// Delete removes all series whose label values start with lvs
+func (v *Vec) Delete(lvs ...string) {
+	k := v.key(lvs)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for s := range v.values {
+		if s == k || strings.HasPrefix(s, k+",") {
+			delete(v.values, s)
+		}
+	}
+}
+
+func (v *Vec) key(lvs []string) string {
+	if len(lvs) > len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", v.name, len(v.labels), len(lvs)))
+	}
+	pairs := make([]string, len(lvs))
+	for i, lv := range lvs {
+		pairs[i] = v.labels[i] + `="` + labelEscaper.Replace(lv) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (v *Vec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	writeHeader(w, v.name, v.help, v.typ)
+	for _, k := range sortedKeys(v.values) {
+		writeSample(w, v.name, k, v.values[k])
+	}
+}
+
+// GaugeFunc is a gauge without labels whose value is read on every scrape
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func NewGaugeFunc(name string, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	Default.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	writeSample(w, g.name, "", g.fn())
+}
+
+// DefBuckets are the default histogram buckets in seconds
+var DefBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+	keys    *Vec
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  map[string]*histogram{},
+		keys:    &Vec{name: name, labels: labels},
+	}
+	Default.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(val float64, lvs ...string) {
+	k := h.keys.key(lvs)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.values[k]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = s
+	}
+	for i, b := range h.buckets {
+		if val <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += val
+	s.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, k := range sortedKeys(h.values) {
+		s := h.values[k]
+		sep := ""
+		if k != "" {
+			sep = ","
+		}
+		for i, b := range h.buckets {
+			writeSample(w, h.name+"_bucket", k+sep+`le="`+formatFloat(b)+`"`, float64(s.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", k+sep+`le="+Inf"`, float64(s.count))
+		writeSample(w, h.name+"_sum", k, s.sum)
+		writeSample(w, h.name+"_count", k, float64(s.count))
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeHeader(w io.Writer, name string, help string, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSample(w io.Writer, name string, labels string, val float64) {
+	if labels != "" {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(val))
+	} else {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(val))
+	}
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
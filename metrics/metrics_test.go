@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	tests := []struct {
+		name   string
+		create func(r *Registry)
+		want   string
+	}{
+		{
+			name: "gauge without labels",
+			create: func(r *Registry) {
+				v := &Vec{name: "up", help: "Up", typ: "gauge", values: map[string]float64{}}
+				r.register(v)
+				v.Set(1)
+			},
+			want: "# HELP up Up\n# TYPE up gauge\nup 1\n",
+		},
+		{
+			name: "counter with sorted and escaped labels",
+			create: func(r *Registry) {
+				v := &Vec{name: "errs_total", help: "Errors", typ: "counter", labels: []string{"id", "name"}, values: map[string]float64{}}
+				r.register(v)
+				v.Inc("b", `say "hi"`)
+				v.Add(2.5, "a", "back\\slash\nline")
+			},
+			want: "# HELP errs_total Errors\n# TYPE errs_total counter\n" +
+				`errs_total{id="a",name="back\\slash\nline"} 2.5` + "\n" +
+				`errs_total{id="b",name="say \"hi\""} 1` + "\n",
+		},
+		{
+			name: "deleted series",
+			create: func(r *Registry) {
+				v := &Vec{name: "soc", help: "SoC", typ: "gauge", labels: []string{"id", "name"}, values: map[string]float64{}}
+				r.register(v)
+				v.Set(80, "a", "old")
+				v.Set(70, "ab", "other")
+				v.Set(60, "a", "new")
+				v.Delete("a")
+			},
+			want: "# HELP soc SoC\n# TYPE soc gauge\n" + `soc{id="ab",name="other"} 70` + "\n",
+		},
+		{
+			name: "special floats",
+			create: func(r *Registry) {
+				for _, g := range []*GaugeFunc{
+					{name: "pos", help: "P", fn: func() float64 { return math.Inf(1) }},
+					{name: "neg", help: "N", fn: func() float64 { return math.Inf(-1) }},
+					{name: "nan", help: "X", fn: math.NaN},
+				} {
+					r.register(g)
+				}
+			},
+			want: "# HELP pos P\n# TYPE pos gauge\npos +Inf\n" +
+				"# HELP neg N\n# TYPE neg gauge\nneg -Inf\n" +
+				"# HELP nan X\n# TYPE nan gauge\nnan NaN\n",
+		},
+		{
+			name: "histogram with labels",
+			create: func(r *Registry) {
+				h := &Histogram{name: "req_seconds", help: "Requests", labels: []string{"op"}, buckets: []float64{.1, 1},
+					values: map[string]*histogram{}, keys: &Vec{name: "req_seconds", labels: []string{"op"}}}
+				r.register(h)
+				h.Observe(.05, "get")
+				h.Observe(.5, "get")
+				h.Observe(2, "get")
+			},
+			want: "# HELP req_seconds Requests\n# TYPE req_seconds histogram\n" +
+				`req_seconds_bucket{op="get",le="0.1"} 1` + "\n" +
+				`req_seconds_bucket{op="get",le="1"} 2` + "\n" +
+				`req_seconds_bucket{op="get",le="+Inf"} 3` + "\n" +
+				`req_seconds_sum{op="get"} 2.55` + "\n" +
+				`req_seconds_count{op="get"} 3` + "\n",
+		},
+		{
+			name: "histogram without labels",
+			create: func(r *Registry) {
+				h := &Histogram{name: "d", help: "D", buckets: []float64{1}, values: map[string]*histogram{}, keys: &Vec{name: "d"}}
+				r.register(h)
+				h.Observe(3)
+			},
+			want: "# HELP d D\n# TYPE d histogram\n" +
+				`d_bucket{le="1"} 0` + "\n" + `d_bucket{le="+Inf"} 1` + "\n" +
+				"d_sum 3\nd_count 1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Registry{}
+			tt.create(r)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+				t.Errorf("content type %q", ct)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configField is a scalar leaf of DotEnv, addressed by its yaml keys
+type configField struct {
+	path  []string
+	value reflect.Value
+}
+
+// Key returns the dotted yaml path, which is also the flag name
+func (f configField) Key() string {
+	return strings.Join(f.path, ".")
+}
+
+// EnvName returns the environment variable overriding the field
+func (f configField) EnvName() string {
+	return strings.ToUpper(strings.Join(f.path, "_"))
+}
+
+// configFields returns all scalar fields of the struct v points to
+func configFields(v reflect.Value, path []string) []configField {
+	var fields []configField
+	v = reflect.Indirect(v)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := yamlName(sf)
+		if name == "" {
+			continue
+		}
+		fp := append(append([]string(nil), path...), name)
+		fv := v.Field(i)
+		switch {
+		case fv.Kind() == reflect.Struct:
+			fields = append(fields, configFields(fv, fp)...)
+		case isScalar(fv):
+			fields = append(fields, configField{path: fp, value: fv})
+		}
+	}
+	return fields
+}
+
+func yamlName(sf reflect.StructField) string {
+	if !sf.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		name = strings.ToLower(sf.Name)
+	}
+	return name
+}
+
+func isScalar(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return v.Type().Elem().Kind() == reflect.String
+	case reflect.Pointer:
+		return isScalar(reflect.New(v.Type().Elem()).Elem())
+	}
+	return false
+}
+
+// setField parses s into v; durations use time.ParseDuration and string
+// slices are comma separated
+func setField(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.Pointer:
+		nv := reflect.New(v.Type().Elem())
+		if err := setField(nv.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(nv)
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			v.SetInt(int64(d))
+			return nil
+		}
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		sl := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			sl.Index(i).SetString(item)
+		}
+		v.Set(sl)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// registerConfigFlags defines a string flag named by the dotted yaml path for
+// every scalar field of DotEnv
+func registerConfigFlags(fs *flag.FlagSet) map[string]*string {
+	flags := map[string]*string{}
+	for _, f := range configFields(reflect.ValueOf(&DotEnv{}), nil) {
+		flags[f.Key()] = fs.String(f.Key(), "", fmt.Sprintf("overrides %s and env %s", f.Key(), f.EnvName()))
+	}
+	return flags
+}
+
+// applyEnv overrides the fields of conf from the environment. NAME_FILE reads
+// the value from a file, e.g. a Docker or Kubernetes secret.
+func applyEnv(conf *DotEnv) error {
+	var errs []error
+	for _, f := range configFields(reflect.ValueOf(conf), nil) {
+		name := f.EnvName()
+		val, ok := os.LookupEnv(name)
+		if path, fok := os.LookupEnv(name + "_FILE"); fok {
+			if ok {
+				errs = append(errs, fmt.Errorf("%s and %s_FILE are both set", name, name))
+				continue
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s_FILE: %w", name, err))
+				continue
+			}
+			val, ok = strings.TrimRight(string(b), "\r\n"), true
+		}
+		if !ok {
+			continue
+		}
+		if err := setField(f.value, val); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// applyFlags overrides the fields of conf from the flags set on the command line
+func applyFlags(conf *DotEnv, fs *flag.FlagSet, flags map[string]*string) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var errs []error
+	for _, f := range configFields(reflect.ValueOf(conf), nil) {
+		if !set[f.Key()] {
+			continue
+		}
+		if err := setField(f.value, *flags[f.Key()]); err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %w", f.Key(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
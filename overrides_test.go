@@ -0,0 +1,172 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "token")
+	if err := os.WriteFile(secret, []byte("file-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	const file = `
+silence:
+  email: yaml@example.org
+  password: yaml-password
+influx:
+  url: http://yaml:8086
+  token: yaml-token
+home_assistant:
+  mqtt_server: tcp://yaml:1883
+poll_interval: 20s
+`
+	type want struct {
+		url      string
+		token    string
+		password string
+		poll     time.Duration
+		pageSize int32
+	}
+	fromFile := want{"http://yaml:8086", "yaml-token", "yaml-password", 20 * time.Second, 50}
+	tests := []struct {
+		name string
+		// file is the content of .env.yaml, "" if there is none
+		file     string
+		optional bool
+		env      map[string]string
+		args     []string
+		want     want
+		wantErr  string
+	}{
+		{
+			name: "file and defaults",
+			file: file,
+			want: fromFile,
+		},
+		{
+			name: "env over file",
+			file: file,
+			env:  map[string]string{"INFLUX_URL": "http://env:8086", "POLL_INTERVAL": "40s", "TRIPS_PAGE_SIZE": "100"},
+			want: want{"http://env:8086", "yaml-token", "yaml-password", 40 * time.Second, 100},
+		},
+		{
+			name: "flag over env",
+			file: file,
+			env:  map[string]string{"INFLUX_URL": "http://env:8086", "POLL_INTERVAL": "40s"},
+			args: []string{"-influx.url=http://flag:8086"},
+			want: want{"http://flag:8086", "yaml-token", "yaml-password", 40 * time.Second, 50},
+		},
+		{
+			name: "file secret over file",
+			file: file,
+			env:  map[string]string{"INFLUX_TOKEN_FILE": secret},
+			want: want{"http://yaml:8086", "file-token", "yaml-password", 20 * time.Second, 50},
+		},
+		{
+			name: "flag over file secret",
+			file: file,
+			env:  map[string]string{"INFLUX_TOKEN_FILE": secret},
+			args: []string{"-influx.token=flag-token"},
+			want: want{"http://yaml:8086", "flag-token", "yaml-password", 20 * time.Second, 50},
+		},
+		{
+			name: "env only",
+			env: map[string]string{
+				"SILENCE_EMAIL":              "env@example.org",
+				"SILENCE_PASSWORD":           "env-password",
+				"INFLUX_URL":                 "http://env:8086",
+				"INFLUX_TOKEN_FILE":          secret,
+				"HOME_ASSISTANT_MQTT_SERVER": "tcp://env:1883",
+			},
+			optional: true,
+			want:     want{"http://env:8086", "file-token", "env-password", 30 * time.Second, 50},
+		},
+		{
+			name:    "missing file",
+			wantErr: "no such file",
+		},
+		{
+			name:    "value and file secret both set",
+			file:    file,
+			env:     map[string]string{"INFLUX_TOKEN": "env-token", "INFLUX_TOKEN_FILE": secret},
+			wantErr: "INFLUX_TOKEN and INFLUX_TOKEN_FILE are both set",
+		},
+		{
+			name:    "unreadable file secret",
+			file:    file,
+			env:     map[string]string{"SILENCE_PASSWORD_FILE": filepath.Join(dir, "missing")},
+			wantErr: "SILENCE_PASSWORD_FILE: ",
+		},
+		{
+			name:    "invalid env value",
+			file:    file,
+			env:     map[string]string{"TRIPS_PAGE_SIZE": "many"},
+			wantErr: "TRIPS_PAGE_SIZE: ",
+		},
+		{
+			name:    "invalid flag value",
+			file:    file,
+			args:    []string{"-poll_interval=soon"},
+			wantErr: "-poll_interval: ",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := filepath.Join(dir, "missing.yaml")
+			if tt.file != "" {
+				path = filepath.Join(dir, fmt.Sprintf("env%d.yaml", i))
+				if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags := registerConfigFlags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			conf, err := loadConfig(path, tt.optional, fs, flags)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := want{conf.Influx.Url, string(conf.Influx.Token), string(conf.Silence.Password), conf.PollInterval, conf.Trips.PageSize}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigFieldNames(t *testing.T) {
+	names := map[string]string{}
+	for _, f := range configFields(reflect.ValueOf(&DotEnv{}), nil) {
+		names[f.Key()] = f.EnvName()
+	}
+	for key, env := range map[string]string{
+		"silence.email":              "SILENCE_EMAIL",
+		"influx.token":               "INFLUX_TOKEN",
+		"home_assistant.mqtt_server": "HOME_ASSISTANT_MQTT_SERVER",
+		"poll_interval":              "POLL_INTERVAL",
+	} {
+		if names[key] != env {
+			t.Errorf("%s: env %q, want %q", key, names[key], env)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/aeytom/silence-data/metrics"
+)
+
+// startHttpServer serves /metrics, /healthz and /readyz on Conf.Http.Listen,
+// if set; the address is bound before it returns
+func startHttpServer(health *Health) (*http.Server, error) {
+	if Conf.Http.Listen == "" {
+		return nil, nil
+	}
+	ln, err := net.Listen("tcp", Conf.Http.Listen)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", health.ServeHealthz)
+	mux.HandleFunc("/readyz", health.ServeReadyz)
+	srv := &http.Server{Addr: Conf.Http.Listen, Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Error("http server", "err", err)
+		}
+	}()
+	return srv, nil
+}
@@ -5,11 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/aeytom/silence-data/metrics"
 )
 
 const (
@@ -19,6 +24,27 @@ const (
 	debugHttp = false
 )
 
+var (
+	logger = slog.Default()
+
+	apiDuration = metrics.NewHistogram("silence_api_request_duration_seconds",
+		"Duration of Silence API requests", metrics.DefBuckets, "endpoint")
+	apiErrors = metrics.NewCounter("silence_api_errors_total",
+		"Failed Silence API requests", "endpoint")
+	tokenRefreshes = metrics.NewCounter("silence_api_token_refreshes_total",
+		"Renewals of the Silence API bearer token")
+)
+
+// ErrorCount returns the number of failed API requests
+func ErrorCount() float64 {
+	return apiErrors.Sum()
+}
+
+// SetLogger sets the logger of the package
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
 type LoginRequest struct {
 	Email    string `json:"email,omitempty"`
 	Password string `json:"password,omitempty"`
@@ -109,23 +135,54 @@ type ScooterResp struct {
 	LastConnection      string `json:"lastConnection"`
 }
 
+// LogValue omits the personal data of the profile
+func (p ProfileResponse) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("id", p.Id),
+		slog.String("country", p.Country),
+		slog.Bool("emailVerified", p.EmailVerified),
+	)
+}
+
+// LogValue omits identifiers and the location of the scooter
+func (sc ScooterResp) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("id", sc.Id),
+		slog.String("name", sc.Name),
+		slog.String("model", sc.Model),
+		slog.String("firmware", sc.TrackingDevice.FirmwareVersion),
+		slog.Int("status", int(sc.Status)),
+		slog.Int("batterySoc", int(sc.BatterySoc)),
+		slog.Bool("charging", sc.Charging),
+		slog.Bool("batteryOut", sc.BatteryOut),
+		slog.Bool("alarmActivated", sc.AlarmActivated),
+		slog.Int("odometer", int(sc.Odometer)),
+		slog.Int("range", int(sc.Range)),
+		slog.Int("velocity", int(sc.Velocity)),
+		slog.String("lastReportTime", sc.LastReportTime),
+		slog.String("lastConnection", sc.LastConnection),
+	)
+}
+
 type Trip struct {
-	Id              string  `json:"id,omitempty"`
-	StartDate       string  `json:"startDate,omitempty"`
-	EndDate         string  `json:"endDate,omitempty"`
-	StartBattery    int16   `json:"startBattery,omitempty"`
-	EndBattery      int16   `json:"endBattery,omitempty"`
-	Distance        int32   `json:"distance,omitempty"`
-	SpeedMax        float32 `json:"speedMax,omitempty"`
-	SpeedAvg        float32 `json:"speedAvg,omitempty"`
-	Co2Savings      float32 `json:"co2Savings,omitempty"`
-	FromDescription string  `json:"fromDescription,omitempty"`
-	ToDescription   string  `json:"toDescription,omitempty"`
-	Points          struct {
-		Lat       float32 `json:"lat,omitempty"`
-		Lon       float32 `json:"lon,omitempty"`
-		Timestamp string  `json:"timestamp,omitempty"`
-	} `json:"points,omitempty"`
+	Id              string      `json:"id,omitempty"`
+	StartDate       string      `json:"startDate,omitempty"`
+	EndDate         string      `json:"endDate,omitempty"`
+	StartBattery    int16       `json:"startBattery,omitempty"`
+	EndBattery      int16       `json:"endBattery,omitempty"`
+	Distance        int32       `json:"distance,omitempty"`
+	SpeedMax        float32     `json:"speedMax,omitempty"`
+	SpeedAvg        float32     `json:"speedAvg,omitempty"`
+	Co2Savings      float32     `json:"co2Savings,omitempty"`
+	FromDescription string      `json:"fromDescription,omitempty"`
+	ToDescription   string      `json:"toDescription,omitempty"`
+	Points          []TripPoint `json:"points,omitempty"`
+}
+
+type TripPoint struct {
+	Lat       float32 `json:"lat,omitempty"`
+	Lon       float32 `json:"lon,omitempty"`
+	Timestamp string  `json:"timestamp,omitempty"`
 }
 
 type TripsListResponse struct {
@@ -136,19 +193,37 @@ type TripsListResponse struct {
 }
 
 type Silence struct {
+	mu           sync.Mutex
 	auth         LoginResponse
 	expiresAfter time.Time
 }
 
+// Authenticated reports whether a bearer token is available
+func (s *Silence) Authenticated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.auth.IdToken != ""
+}
+
+// TokenExpiry returns the time the current bearer token expires
+func (s *Silence) TokenExpiry() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expiresAfter
+}
+
 func (s *Silence) addReqHeaders(req *http.Request) {
 
 	if err := s.refreshToken(); err != nil {
-		log.Fatalln(err)
+		logger.Error("token refresh failed", "err", err)
+		os.Exit(1)
 	}
 
+	s.mu.Lock()
 	if s.auth.IdToken != "" {
 		req.Header.Set("authorization", "Bearer "+s.auth.IdToken)
 	}
+	s.mu.Unlock()
 
 	req.Header.Set("x-userrole", "Mgmt.Customer")
 	req.Header.Set("x-useragent", "APP")
@@ -219,54 +294,61 @@ func (s *Silence) Get(path string, res any, values url.Values) error {
 
 func (s *Silence) Login(email string, password string) error {
 	now := time.Now()
+	var auth LoginResponse
 
 	if err := s.Post("login", LoginRequest{
 		Email:    email,
 		Password: password,
 		Version:  version,
-	}, &s.auth); err != nil {
+	}, &auth); err != nil {
 		return err
 	}
 
-	expin, err := time.ParseDuration(s.auth.ExpiresIn + "s")
+	expin, err := time.ParseDuration(auth.ExpiresIn + "s")
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
+	s.auth = auth
 	s.expiresAfter = now.Add(expin)
+	s.mu.Unlock()
 
 	return nil
 }
 
 // refreshToken renews authentication bearer token
 func (s *Silence) refreshToken() error {
-
-	if s.auth.RefreshToken == "" {
+	s.mu.Lock()
+	if s.auth.RefreshToken == "" || !time.Now().After(s.expiresAfter) {
+		s.mu.Unlock()
 		return nil
 	}
 
-	if time.Now().After(s.expiresAfter) {
-		now := time.Now()
-		qrt := RefreshTokenRequest{
-			Token:   s.auth.RefreshToken,
-			Version: version,
-		}
-		resp := RefreshTokenResp{}
-		s.auth.IdToken = ""
-		s.auth.RefreshToken = ""
-		if err := s.Post("refreshToken", qrt, &resp); err != nil {
-			return err
-		} else {
-			s.auth.IdToken = resp.IdToken
-			s.auth.RefreshToken = resp.RefreshToken
-			s.auth.ExpiresIn = resp.ExpiresIn
-			expin, err := time.ParseDuration(s.auth.ExpiresIn + "s")
-			if err != nil {
-				return err
-			}
-			s.expiresAfter = now.Add(expin)
-		}
+	now := time.Now()
+	qrt := RefreshTokenRequest{
+		Token:   s.auth.RefreshToken,
+		Version: version,
+	}
+	s.auth.IdToken = ""
+	s.auth.RefreshToken = ""
+	s.mu.Unlock()
 
+	resp := RefreshTokenResp{}
+	tokenRefreshes.Inc()
+	if err := s.Post("refreshToken", qrt, &resp); err != nil {
+		return err
+	}
+	expin, err := time.ParseDuration(resp.ExpiresIn + "s")
+	if err != nil {
+		return err
 	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auth.IdToken = resp.IdToken
+	s.auth.RefreshToken = resp.RefreshToken
+	s.auth.ExpiresIn = resp.ExpiresIn
+	s.expiresAfter = now.Add(expin)
 	return nil
 }
 
@@ -295,14 +377,19 @@ func (s *Silence) Avatar() error {
 	if err := s.Get("me/avatar", &avatar, nil); err != nil {
 		return err
 	}
-	fmt.Printf("%#v", avatar)
+	logger.Debug("avatar", "avatar", avatar)
 	return nil
 }
 
-func (s *Silence) TripsList(sid string, limit int32) (TripsListResponse, error) {
+// TripsList returns a page of trips of scooter sid. Pass the Offset of the
+// previous response to fetch the next page, or "" for the first page.
+func (s *Silence) TripsList(sid string, limit int32, offset string) (TripsListResponse, error) {
 	args := url.Values{
 		"limit": {fmt.Sprint(limit)},
 	}
+	if offset != "" {
+		args.Set("offset", offset)
+	}
 	var trips TripsListResponse
 	err := s.Get("scooters/"+sid+"/trips", &trips, args)
 	return trips, err
@@ -314,10 +401,18 @@ func (s *Silence) Trip(id string, tid string) (Trip, error) {
 	return trip, err
 }
 
-func (s *Silence) doHttpRequest(req *http.Request) (*http.Response, error) {
+func (s *Silence) doHttpRequest(req *http.Request) (resp *http.Response, err error) {
+	endpoint := endpointName(req.URL.Path)
+	defer func(start time.Time) {
+		apiDuration.Observe(time.Since(start).Seconds(), endpoint)
+		if err != nil || resp.StatusCode >= 400 {
+			apiErrors.Inc(endpoint)
+		}
+	}(time.Now())
+
 	s.addReqHeaders(req)
 	debugHttpRequest(req)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err = http.DefaultClient.Do(req)
 	if err != nil {
 		return resp, err
 	}
@@ -339,13 +434,29 @@ func (s *Silence) doHttpRequest(req *http.Request) (*http.Response, error) {
 	return resp, err
 }
 
+// endpointName replaces the ids in an API path by placeholders
+func endpointName(path string) string {
+	path = strings.TrimPrefix(path, "/api/v1/")
+	parts := strings.Split(path, "/")
+	for i := 1; i < len(parts); i++ {
+		switch parts[i-1] {
+		case "scooters":
+			parts[i] = ":id"
+		case "trips":
+			parts[i] = ":trip"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
 func debugHttpRequest(req *http.Request) {
 	if debugHttp {
 		reqDump, err := httputil.DumpRequestOut(req, true)
 		if err != nil {
-			log.Fatal(err)
+			logger.Error("dump request", "err", err)
+			return
 		}
-		fmt.Printf("REQUEST:\n%s\n", string(reqDump))
+		logger.Debug("request", "dump", string(reqDump))
 	}
 }
 
@@ -353,8 +464,9 @@ func debugHttpResponse(resp *http.Response) {
 	if debugHttp {
 		respDump, err := httputil.DumpResponse(resp, true)
 		if err != nil {
-			log.Fatal(err)
+			logger.Error("dump response", "err", err)
+			return
 		}
-		fmt.Printf("RESPONSE:\n%s\n", string(respDump))
+		logger.Debug("response", "dump", string(respDump))
 	}
 }
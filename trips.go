@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/aeytom/silence-data/hass"
+	"github.com/aeytom/silence-data/silence"
+	"github.com/aeytom/silence-data/state"
+)
+
+const (
+	tripCursorFile = "trip-cursor.json"
+	// tripEndedDelay is the wait after the last trip_ended event before the
+	// trips of the scooter are synced; the API lists a trip a while after
+	// it ended
+	tripEndedDelay = time.Minute
+)
+
+type tripCursor struct {
+	LastStart time.Time `json:"last_start"`
+	LastId    string    `json:"last_id,omitempty"`
+}
+
+// TripSync copies the trip history of all scooters into InfluxDB. The start
+// time of the newest written trip is stored per scooter, so reruns only
+// fetch trips which started later.
+//
+// If ha is set, the last trip and the daily, weekly and monthly totals are
+// published to Home Assistant after new trips and once a day.
+type TripSync struct {
+	si       *silence.Silence
+	ix       *InfluxWriter
+	ha       *hass.Client
+	path     string
+	pageSize int32
+	cursors  map[string]tripCursor
+	stats    map[string]time.Time
+}
+
+func NewTripSync(si *silence.Silence, ix *InfluxWriter, ha *hass.Client) *TripSync {
+	ts := &TripSync{
+		si:       si,
+		ix:       ix,
+		ha:       ha,
+		stats:    map[string]time.Time{},
+		path:     filepath.Join(Conf.StateDir, tripCursorFile),
+		pageSize: Conf.Trips.PageSize,
+		cursors:  map[string]tripCursor{},
+	}
+	if err := state.Load(ts.path, &ts.cursors); err != nil {
+		logger.Warn("load trip cursor", "path", ts.path, "err", err)
+	}
+	return ts
+}
+
+// Run syncs the trips of all scooters every interval until ctx is done. The
+// ids received from ended are synced tripEndedDelay after their last trip
+// ended.
+func (ts *TripSync) Run(ctx context.Context, interval time.Duration, ended <-chan string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	debounce := time.NewTimer(tripEndedDelay)
+	debounce.Stop()
+	pending := map[string]bool{}
+	ts.syncIds(nil)
+	for {
+		select {
+		case <-ctx.Done():
+			debounce.Stop()
+			return
+		case <-ticker.C:
+			ts.syncIds(nil)
+		case id := <-ended:
+			pending[id] = true
+			debounce.Reset(tripEndedDelay)
+		case <-debounce.C:
+			ts.syncIds(pending)
+			pending = map[string]bool{}
+		}
+	}
+}
+
+// syncIds syncs the trips of the scooters in ids, or of all if ids is nil
+func (ts *TripSync) syncIds(ids map[string]bool) {
+	scooters, err := ts.si.Details()
+	if err != nil {
+		logger.Error("fetch scooters", "err", err)
+		return
+	}
+	if ids != nil {
+		scooters = slices.DeleteFunc(scooters, func(sc silence.ScooterResp) bool { return !ids[sc.Id] })
+	}
+	if err := ts.Sync(scooters); err != nil {
+		logger.Error("trip sync", "err", err)
+	}
+}
+
+// Sync writes all trips of scooters which are newer than the stored cursor.
+// A failing scooter does not stop the others; all errors are returned.
+func (ts *TripSync) Sync(scooters []silence.ScooterResp) error {
+	var errs []error
+	for _, sc := range scooters {
+		n, err := ts.syncScooter(sc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("scooter %s: %w", sc.Id, err))
+			continue
+		}
+		if n > 0 {
+			logger.Info("wrote trips", "scooter", sc.Id, "count", n)
+			if err := state.Save(ts.path, ts.cursors); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if err := ts.sendStats(sc, n > 0, time.Now()); err != nil {
+			logger.Error("trip statistics", "scooter", sc.Id, "err", err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sendStats publishes the trip statistics of a scooter if there are new
+// trips, or they were not published yet today
+func (ts *TripSync) sendStats(sc silence.ScooterResp, fresh bool, now time.Time) error {
+	if ts.ha == nil {
+		return nil
+	}
+	day, _, _ := periodStarts(now)
+	if !fresh && !ts.stats[sc.Id].Before(day) {
+		return nil
+	}
+	st, err := ts.tripStats(sc, now)
+	if err != nil {
+		return err
+	}
+	ts.ha.SendTripStats(sc, st)
+	ts.stats[sc.Id] = now
+	return nil
+}
+
+// tripStats pages through the trips of the current month and week and
+// returns the last trip and the totals
+func (ts *TripSync) tripStats(sc silence.ScooterResp, now time.Time) (hass.TripStats, error) {
+	var st hass.TripStats
+	day, week, month := periodStarts(now)
+	oldest := month
+	if week.Before(month) {
+		oldest = week
+	}
+	offset := ""
+	for first := true; ; first = false {
+		page, err := ts.si.TripsList(sc.Id, ts.pageSize, offset)
+		if err != nil {
+			return st, err
+		}
+		for i, trip := range page.Items {
+			start, err := time.Parse(time.RFC3339, trip.StartDate)
+			if err != nil {
+				continue
+			}
+			if first && i == 0 {
+				setLastTrip(&st, trip, start)
+			}
+			if start.Before(oldest) {
+				return st, nil
+			}
+			d := int64(trip.Distance)
+			if !start.Before(day) {
+				st.TripDistanceToday += d
+				st.TripsToday++
+			}
+			if !start.Before(week) {
+				st.TripDistanceWeek += d
+				st.TripsWeek++
+			}
+			if !start.Before(month) {
+				st.TripDistanceMonth += d
+				st.TripsMonth++
+			}
+		}
+		if len(page.Items) == 0 || page.Left <= 0 || page.Offset == "" || page.Offset == offset {
+			return st, nil
+		}
+		offset = page.Offset
+	}
+}
+
+func setLastTrip(st *hass.TripStats, trip silence.Trip, start time.Time) {
+	st.LastTripDistance = trip.Distance
+	st.LastTripSpeedAvg = trip.SpeedAvg
+	st.LastTripSpeedMax = trip.SpeedMax
+	st.LastTripBatteryUsed = trip.StartBattery - trip.EndBattery
+	st.LastTripCo2Savings = trip.Co2Savings
+	st.LastTripFrom = trip.FromDescription
+	st.LastTripTo = trip.ToDescription
+	if end, err := time.Parse(time.RFC3339, trip.EndDate); err == nil {
+		st.LastTripDuration = end.Sub(start).Seconds()
+		st.LastTripEnd = end.Format(time.RFC3339)
+	}
+}
+
+// periodStarts returns the start of the day, the week (Monday) and the month
+// of t in its location
+func periodStarts(t time.Time) (day, week, month time.Time) {
+	day = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	week = day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	month = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	return day, week, month
+}
+
+// syncScooter pages through the trips of a scooter, newest first, and stops
+// at the first page without unseen trips. The cursor is only advanced when
+// all unseen trips were written, so a failed walk is retried from the old
+// cursor; rewriting a trip to InfluxDB replaces the same points.
+func (ts *TripSync) syncScooter(sc silence.ScooterResp) (int, error) {
+	cur := ts.cursors[sc.Id]
+	newest := cur
+	offset := ""
+	n := 0
+
+	for {
+		page, err := ts.si.TripsList(sc.Id, ts.pageSize, offset)
+		if err != nil {
+			return n, err
+		}
+		fresh := 0
+		for _, item := range page.Items {
+			start, err := time.Parse(time.RFC3339, item.StartDate)
+			if err != nil {
+				logger.Warn("invalid trip start", "trip", item.Id, "err", err)
+				continue
+			}
+			if !start.After(cur.LastStart) {
+				continue
+			}
+			fresh++
+			trip, err := ts.si.Trip(sc.Id, item.Id)
+			if err != nil {
+				return n, err
+			}
+			if trip.Id == "" {
+				trip.Id = item.Id
+			}
+			if err := sendTripToInflux(ts.ix, sc, trip); err != nil {
+				return n, err
+			}
+			n++
+			if start.After(newest.LastStart) {
+				newest = tripCursor{LastStart: start, LastId: item.Id}
+			}
+		}
+		if len(page.Items) == 0 || page.Left <= 0 || page.Offset == "" || page.Offset == offset ||
+			fresh == 0 && !cur.LastStart.IsZero() {
+			ts.cursors[sc.Id] = newest
+			return n, nil
+		}
+		offset = page.Offset
+	}
+}